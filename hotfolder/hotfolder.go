@@ -0,0 +1,476 @@
+//Package hotfolder processes files that are dropped in an inbox directory,
+//each file is claimed, handed to a handler and moved to done or failed
+package hotfolder
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/timeglass/snow/monitor"
+)
+
+var ErrAlreadyStarted = errors.New("The hot folder is already running")
+var ErrAlreadyStopped = errors.New("The hot folder is already not running")
+
+//the number of latency intervals the inbox has to be stable for before the
+//monitor reports its files complete, on backends that cannot tell when a
+//file is closed after writing
+const completionIntervals = 4
+
+//events for the inbox are throttled for at most this long, a file of which
+//the completion is dropped by it is complete after the settle duration
+const maxLatency = time.Millisecond * 50
+
+//files with these suffixes are still being written and
+//will be renamed by their writer once they are complete
+var partialSuffixes = []string{".tmp", ".part", ".partial", ".crdownload"}
+
+//Handler processes a single file, path is where it is while processing. A file
+//for which it returns an error is retried and eventually moved to failed
+type Handler func(path string) error
+
+//Option configures a hot folder
+type Option func(f *Folder) error
+
+//a file in the inbox that is possibly still being written, it is complete
+//when the monitor reported so and it didn't change since
+type arrival struct {
+	size     int64
+	mod      time.Time
+	since    time.Time
+	complete bool
+}
+
+//Folder watches the inbox directory of a hot folder
+type Folder struct {
+	dir         string
+	inbox       string
+	processing  string
+	done        string
+	failed      string
+	handler     Handler
+	concurrency int
+	attempts    int
+	backoff     time.Duration
+	settle      time.Duration
+	m           monitor.M
+	arrivals    map[string]arrival
+	claimed     map[string]bool
+	slots       chan struct{}
+	errors      chan error
+	stop        chan struct{}
+	wg          sync.WaitGroup
+}
+
+//New creates a hot folder in the given directory, with the inbox, processing,
+//done and failed directories inside of it. By default files are handled one at
+//a time and a single attempt is made. Files are complete once the monitor of the
+//inbox reports them written or else once their size and modification time didn't
+//change for a second
+func New(dir string, handler Handler, opts ...Option) (*Folder, error) {
+	if handler == nil {
+		return nil, fmt.Errorf("A handler is required for hot folder '%s'", dir)
+	}
+
+	f := &Folder{
+		dir:         dir,
+		inbox:       filepath.Join(dir, "inbox"),
+		processing:  filepath.Join(dir, "processing"),
+		done:        filepath.Join(dir, "done"),
+		failed:      filepath.Join(dir, "failed"),
+		handler:     handler,
+		concurrency: 1,
+		attempts:    1,
+		settle:      time.Second,
+		errors:      make(chan error),
+	}
+
+	for _, opt := range opts {
+		err := opt(f)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid option for hot folder '%s': %s", dir, err)
+		}
+	}
+
+	for _, sub := range []string{f.inbox, f.processing, f.done, f.failed} {
+		err := os.MkdirAll(sub, 0755)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create '%s': %s", sub, err)
+		}
+	}
+
+	return f, nil
+}
+
+//WithConcurrency sets how many files are handled at the same time
+func WithConcurrency(n int) Option {
+	return func(f *Folder) error {
+		if n < 1 {
+			return fmt.Errorf("Concurrency must be at least 1, got: %d", n)
+		}
+
+		f.concurrency = n
+		return nil
+	}
+}
+
+//WithRetries sets how many times a file is handled before it is moved to failed,
+//the backoff is waited before the second attempt and doubles for every next one
+func WithRetries(attempts int, backoff time.Duration) Option {
+	return func(f *Folder) error {
+		if attempts < 1 {
+			return fmt.Errorf("Attempts must be at least 1, got: %d", attempts)
+		}
+
+		if backoff < 0 {
+			return fmt.Errorf("Backoff cannot be negative, got: %s", backoff)
+		}
+
+		f.attempts = attempts
+		f.backoff = backoff
+		return nil
+	}
+}
+
+//WithSettle sets how long a file in the inbox may not change before it is
+//considered completely written, when the monitor didn't report it complete
+func WithSettle(settle time.Duration) Option {
+	return func(f *Folder) error {
+		if settle <= 0 {
+			return fmt.Errorf("Settle duration must be positive, got: %s", settle)
+		}
+
+		f.settle = settle
+		return nil
+	}
+}
+
+//Errors delivers every file that failed and every failure to move one, it
+//has to be read from for processing to continue
+func (f *Folder) Errors() <-chan error {
+	return f.errors
+}
+
+//Start handles the files that were left in processing by a previous run
+//that didn't finish, after which files that arrive in the inbox are handled
+func (f *Folder) Start() error {
+	if f.stop != nil {
+		return ErrAlreadyStarted
+	}
+
+	latency := f.settle / completionIntervals
+	if latency > maxLatency {
+		latency = maxLatency
+	}
+
+	m, err := monitor.NewWithOptions(f.inbox,
+		monitor.WithSelector(monitor.NonRecursive),
+		monitor.WithLatency(latency),
+		monitor.WithWriteCompletion(completionIntervals))
+	if err == nil {
+		_, err = m.Start()
+	}
+
+	if err != nil {
+		return fmt.Errorf("Failed to watch '%s': %s", f.inbox, err)
+	}
+
+	f.m = m
+	f.arrivals = map[string]arrival{}
+	f.claimed = map[string]bool{}
+	f.slots = make(chan struct{}, f.concurrency)
+	f.stop = make(chan struct{})
+	f.wg.Add(1)
+	go f.watch(latency)
+	return nil
+}
+
+//Stop waits for the files that are being handled, files that are waiting
+//for another attempt stay in processing until the hot folder starts again
+func (f *Folder) Stop() error {
+	if f.stop == nil {
+		return ErrAlreadyStopped
+	}
+
+	close(f.stop)
+	f.wg.Wait()
+	f.stop = nil
+	return halt(f.m)
+}
+
+//stops the monitor of the inbox, events and errors that
+//are still on their way are discarded until it stopped
+func halt(m monitor.M) error {
+	stopped := make(chan error)
+	go func() {
+		stopped <- m.Stop()
+	}()
+
+	for {
+		select {
+		case <-m.Events():
+		case <-m.Errors():
+		case err := <-stopped:
+			return err
+		}
+	}
+}
+
+func (f *Folder) watch(latency time.Duration) {
+	defer f.wg.Done()
+	err := f.recover()
+	if err != nil {
+		f.fail(err)
+	}
+
+	var recheck <-chan time.Time
+	observed := false
+	for {
+		pending, err := f.scan()
+		if err != nil {
+			f.fail(err)
+		}
+
+		//events within the latency of the monitor are dropped, the
+		//files they are for are picked up by a scan that follows
+		recheck = nil
+		if observed {
+			recheck = time.After(latency)
+		} else if pending {
+			recheck = time.After(f.settle)
+		}
+
+		observed = false
+		select {
+		case ev := <-f.m.Events():
+			f.complete(ev)
+			observed = true
+		case err := <-f.m.Errors():
+			f.fail(err)
+		case <-recheck:
+		case <-f.stop:
+			return
+		}
+	}
+}
+
+//files in processing were claimed by a run that didn't finish
+func (f *Folder) recover() error {
+	fis, err := ioutil.ReadDir(f.processing)
+	if err != nil {
+		return fmt.Errorf("Failed to read '%s': %s", f.processing, err)
+	}
+
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() || !f.acquire() {
+			continue
+		}
+
+		f.wg.Add(1)
+		go f.process(filepath.Join(f.processing, fi.Name()))
+	}
+
+	return nil
+}
+
+//marks a file complete when the monitor reports it closed after writing or
+//moved into the inbox, events for other files or the inbox as a whole don't
+//tell anything about the files that are still being written
+func (f *Folder) complete(ev monitor.DirEvent) {
+	eev, ok := ev.(monitor.EntryEvent)
+	if !ok || eev.Name() == "" {
+		return
+	}
+
+	oev, ok := ev.(monitor.OpEvent)
+	if !ok || oev.Op()&(monitor.Write|monitor.Rename|monitor.Create) == 0 {
+		return
+	}
+
+	//the file was moved out of the inbox by a claim
+	name := eev.Name()
+	if f.claimed[name] {
+		delete(f.claimed, name)
+		return
+	}
+
+	fi, err := os.Lstat(filepath.Join(f.inbox, name))
+	if err != nil || !fi.Mode().IsRegular() || isPartial(name) {
+		return
+	}
+
+	f.arrivals[name] = arrival{fi.Size(), fi.ModTime(), time.Now(), true}
+}
+
+//claims the files in the inbox that are complete, returns whether there are
+//files of which that is not known yet. Files the monitor reported complete
+//are claimed unless they changed since, others are complete once they
+//didn't change for the settle duration since they were first seen
+func (f *Folder) scan() (bool, error) {
+	fis, err := ioutil.ReadDir(f.inbox)
+	if err != nil {
+		return false, fmt.Errorf("Failed to read '%s': %s", f.inbox, err)
+	}
+
+	now := time.Now()
+	pending := false
+	present := map[string]bool{}
+	for _, fi := range fis {
+		name := fi.Name()
+		if !fi.Mode().IsRegular() || isPartial(name) {
+			continue
+		}
+
+		present[name] = true
+		prev, ok := f.arrivals[name]
+		changed := ok && (prev.size != fi.Size() || !prev.mod.Equal(fi.ModTime()))
+		if !ok || changed {
+			f.arrivals[name] = arrival{fi.Size(), fi.ModTime(), now, false}
+			pending = true
+			continue
+		}
+
+		settled := prev.complete || now.Sub(prev.since) >= f.settle
+
+		//one with the same name is still being handled
+		if !settled || exists(filepath.Join(f.processing, name)) {
+			pending = true
+			continue
+		}
+
+		if !f.acquire() {
+			return false, nil
+		}
+
+		delete(f.arrivals, name)
+		path, err := f.claim(name)
+		if err != nil || path == "" {
+			<-f.slots
+			if err != nil {
+				f.fail(err)
+			}
+
+			continue
+		}
+
+		f.claimed[name] = true
+		f.wg.Add(1)
+		go f.process(path)
+	}
+
+	for name := range f.arrivals {
+		if !present[name] {
+			delete(f.arrivals, name)
+		}
+	}
+
+	return pending, nil
+}
+
+//waits for a free slot, returns false when stopped
+func (f *Folder) acquire() bool {
+	select {
+	case f.slots <- struct{}{}:
+		return true
+	case <-f.stop:
+		return false
+	}
+}
+
+//moves a file from the inbox into processing, the rename is atomic such
+//that only one claims it. Returns an empty path if it is already gone
+func (f *Folder) claim(name string) (string, error) {
+	path := filepath.Join(f.processing, name)
+	err := os.Rename(filepath.Join(f.inbox, name), path)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("Failed to claim '%s': %s", name, err)
+	}
+
+	return path, nil
+}
+
+//handles a claimed file until it succeeds or runs out of attempts
+func (f *Folder) process(path string) {
+	defer f.wg.Done()
+	defer func() { <-f.slots }()
+
+	var err error
+	for attempt := 0; attempt < f.attempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(f.backoff << uint(attempt-1)):
+			case <-f.stop:
+				return
+			}
+		}
+
+		err = f.handler(path)
+		if err == nil {
+			break
+		}
+	}
+
+	dir := f.done
+	if err != nil {
+		dir = f.failed
+		f.fail(fmt.Errorf("Failed to process '%s' in %d attempt(s): %s", filepath.Base(path), f.attempts, err))
+	}
+
+	merr := move(path, dir)
+	if merr != nil {
+		f.fail(merr)
+	}
+}
+
+func (f *Folder) fail(err error) {
+	select {
+	case f.errors <- err:
+	case <-f.stop:
+	}
+}
+
+//moves a file into a directory without replacing one
+//that is already there under the same name
+func move(path, dir string) error {
+	name := filepath.Base(path)
+	to := filepath.Join(dir, name)
+	for i := 1; exists(to); i++ {
+		to = filepath.Join(dir, name+"."+strconv.Itoa(i))
+	}
+
+	err := os.Rename(path, to)
+	if err != nil {
+		return fmt.Errorf("Failed to move '%s' to '%s': %s", path, dir, err)
+	}
+
+	return nil
+}
+
+//hidden files and those with a partial suffix are still being written
+func isPartial(name string) bool {
+	if strings.HasPrefix(name, ".") {
+		return true
+	}
+
+	for _, suffix := range partialSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return !os.IsNotExist(err)
+}
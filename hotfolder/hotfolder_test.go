@@ -0,0 +1,298 @@
+package hotfolder
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+var Settle = time.Millisecond * 20
+var Timeout = time.Millisecond * 500
+
+func setupTestDir(t *testing.T) string {
+	tdir, err := ioutil.TempDir("", ".timeglass_hotfolder")
+	if err != nil {
+		t.Fatalf("Failed to create test directory: %s", err)
+	}
+
+	return tdir
+}
+
+func setupTestFolder(t *testing.T, dir string, handler Handler, opts ...Option) *Folder {
+	f, err := New(dir, handler, append([]Option{WithSettle(Settle)}, opts...)...)
+	if err != nil {
+		t.Fatalf("Failed to create hot folder '%s': %s", dir, err)
+	}
+
+	err = f.Start()
+	if err != nil {
+		t.Fatalf("Failed to start hot folder '%s': %s", dir, err)
+	}
+
+	return f
+}
+
+func doWriteFile(t *testing.T, path, data string) {
+	err := ioutil.WriteFile(path, []byte(data), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write file '%s': '%s'", path, err)
+	}
+}
+
+func assertFile(t *testing.T, path string) {
+	deadline := time.Now().Add(Timeout)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(path); err == nil {
+			return
+		}
+
+		<-time.After(Settle / 4)
+	}
+
+	t.Fatalf("Timed out waiting for '%s' to exist", path)
+}
+
+func assertNoFile(t *testing.T, path string) {
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Expected '%s' to not exist, got: %v", path, err)
+	}
+}
+
+func assertError(t *testing.T, f *Folder) {
+	select {
+	case <-f.Errors():
+	case <-time.After(Timeout):
+		t.Fatalf("Timed out waiting for an error")
+	}
+}
+
+func assertStop(t *testing.T, f *Folder) {
+	err := f.Stop()
+	if err != nil {
+		t.Fatalf("Failed to stop: %s", err)
+	}
+}
+
+func TestProcessed(t *testing.T) {
+	tdir := setupTestDir(t)
+	contents := make(chan string, 1)
+	f := setupTestFolder(t, tdir, func(path string) error {
+		data, err := ioutil.ReadFile(path)
+		contents <- string(data)
+		return err
+	})
+
+	doWriteFile(t, filepath.Join(tdir, "inbox", "order.xml"), "<order/>")
+	assertFile(t, filepath.Join(tdir, "done", "order.xml"))
+	if c := <-contents; c != "<order/>" {
+		t.Fatalf("Expected handler to read '<order/>', got: '%s'", c)
+	}
+
+	assertNoFile(t, filepath.Join(tdir, "inbox", "order.xml"))
+	assertNoFile(t, filepath.Join(tdir, "processing", "order.xml"))
+	assertStop(t, f)
+}
+
+func TestProcessedOnceComplete(t *testing.T) {
+	tdir := setupTestDir(t)
+	contents := make(chan string, 1)
+	f := setupTestFolder(t, tdir, func(path string) error {
+		data, err := ioutil.ReadFile(path)
+		contents <- string(data)
+		return err
+	})
+
+	//a writer that is slow, only the complete file is handed over
+	path := filepath.Join(tdir, "inbox", "order.xml")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Failed to create '%s': %s", path, err)
+	}
+
+	for _, part := range []string{"<or", "der", "/>"} {
+		file.WriteString(part)
+		<-time.After(Settle / 2)
+	}
+
+	file.Close()
+	assertFile(t, filepath.Join(tdir, "done", "order.xml"))
+	if c := <-contents; c != "<order/>" {
+		t.Fatalf("Expected handler to read '<order/>', got: '%s'", c)
+	}
+
+	//partial files are left alone
+	doWriteFile(t, filepath.Join(tdir, "inbox", "next.xml.part"), "<ord")
+	<-time.After(Settle * 4)
+	assertFile(t, filepath.Join(tdir, "inbox", "next.xml.part"))
+	assertStop(t, f)
+}
+
+func TestProcessedWhenReportedComplete(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Only inotify tells when a file is closed after writing")
+	}
+
+	tdir := setupTestDir(t)
+
+	//the settle duration never passes during the test
+	f := setupTestFolder(t, tdir, func(path string) error { return nil }, WithSettle(time.Hour))
+
+	doWriteFile(t, filepath.Join(tdir, "inbox", "order.xml"), "<order/>")
+	assertFile(t, filepath.Join(tdir, "done", "order.xml"))
+	assertStop(t, f)
+}
+
+func TestProcessedWhenReportedCompleteOnly(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Only inotify tells when a file is closed after writing")
+	}
+
+	tdir := setupTestDir(t)
+	sizes := make(chan int, 2)
+	f := setupTestFolder(t, tdir, func(path string) error {
+		data, err := ioutil.ReadFile(path)
+		sizes <- len(data)
+		return err
+	}, WithSettle(time.Hour))
+
+	//a writer that holds its file open while another one completes
+	path := filepath.Join(tdir, "inbox", "big.bin")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Failed to create '%s': %s", path, err)
+	}
+
+	defer file.Close()
+	file.Write(make([]byte, 1000))
+	doWriteFile(t, filepath.Join(tdir, "inbox", "small.txt"), "small")
+	assertFile(t, filepath.Join(tdir, "done", "small.txt"))
+	if n := <-sizes; n != 5 {
+		t.Fatalf("Expected handler to read 5 bytes of 'small.txt', got: %d", n)
+	}
+
+	<-time.After(Settle * 4)
+	assertFile(t, path)
+	assertNoFile(t, filepath.Join(tdir, "processing", "big.bin"))
+
+	file.Write(make([]byte, 1000))
+	file.Close()
+	assertFile(t, filepath.Join(tdir, "done", "big.bin"))
+	if n := <-sizes; n != 2000 {
+		t.Fatalf("Expected handler to read 2000 bytes of 'big.bin', got: %d", n)
+	}
+
+	assertStop(t, f)
+}
+
+func TestRetried(t *testing.T) {
+	tdir := setupTestDir(t)
+	attempts := 0
+	f := setupTestFolder(t, tdir, func(path string) error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("Not yet")
+		}
+
+		return nil
+	}, WithRetries(3, time.Millisecond))
+
+	doWriteFile(t, filepath.Join(tdir, "inbox", "order.xml"), "<order/>")
+	assertFile(t, filepath.Join(tdir, "done", "order.xml"))
+	assertStop(t, f)
+	if attempts != 3 {
+		t.Fatalf("Expected 3 attempts, got: %d", attempts)
+	}
+}
+
+func TestFailed(t *testing.T) {
+	tdir := setupTestDir(t)
+	f := setupTestFolder(t, tdir, func(path string) error {
+		return errors.New("Malformed order")
+	}, WithRetries(2, time.Millisecond))
+
+	doWriteFile(t, filepath.Join(tdir, "inbox", "order.xml"), "<order")
+	assertError(t, f)
+	assertFile(t, filepath.Join(tdir, "failed", "order.xml"))
+
+	//a second one with the same name doesn't replace the first
+	doWriteFile(t, filepath.Join(tdir, "inbox", "order.xml"), "<order")
+	assertError(t, f)
+	assertFile(t, filepath.Join(tdir, "failed", "order.xml.1"))
+	assertStop(t, f)
+}
+
+func TestConcurrencyBounded(t *testing.T) {
+	tdir := setupTestDir(t)
+	mu := sync.Mutex{}
+	running, max := 0, 0
+	f := setupTestFolder(t, tdir, func(path string) error {
+		mu.Lock()
+		running++
+		if running > max {
+			max = running
+		}
+
+		mu.Unlock()
+		<-time.After(Settle * 2)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	}, WithConcurrency(2))
+
+	for _, name := range []string{"a.xml", "b.xml", "c.xml", "d.xml"} {
+		doWriteFile(t, filepath.Join(tdir, "inbox", name), "<order/>")
+	}
+
+	for _, name := range []string{"a.xml", "b.xml", "c.xml", "d.xml"} {
+		assertFile(t, filepath.Join(tdir, "done", name))
+	}
+
+	assertStop(t, f)
+	if max != 2 {
+		t.Fatalf("Expected at most 2 files to be handled at the same time, got: %d", max)
+	}
+}
+
+func TestRecovered(t *testing.T) {
+	tdir := setupTestDir(t)
+	err := os.MkdirAll(filepath.Join(tdir, "processing"), 0755)
+	if err != nil {
+		t.Fatalf("Failed to create processing directory: %s", err)
+	}
+
+	//claimed by a run that crashed
+	doWriteFile(t, filepath.Join(tdir, "processing", "order.xml"), "<order/>")
+	f := setupTestFolder(t, tdir, func(path string) error {
+		return nil
+	})
+
+	assertFile(t, filepath.Join(tdir, "done", "order.xml"))
+	assertNoFile(t, filepath.Join(tdir, "processing", "order.xml"))
+	assertStop(t, f)
+}
+
+func TestStoppedDuringBackoff(t *testing.T) {
+	tdir := setupTestDir(t)
+	attempted := make(chan struct{}, 1)
+	f := setupTestFolder(t, tdir, func(path string) error {
+		attempted <- struct{}{}
+		return errors.New("Unavailable")
+	}, WithRetries(2, time.Hour))
+
+	doWriteFile(t, filepath.Join(tdir, "inbox", "order.xml"), "<order/>")
+	select {
+	case <-attempted:
+	case <-time.After(Timeout):
+		t.Fatalf("Timed out waiting for the first attempt")
+	}
+
+	//it stays in processing, to be recovered by the next run
+	assertStop(t, f)
+	assertFile(t, filepath.Join(tdir, "processing", "order.xml"))
+}
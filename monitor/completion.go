@@ -0,0 +1,64 @@
+package monitor
+
+import (
+	"fmt"
+)
+
+//see WithWriteCompletion()
+func (m *monitor) setWriteCompletion(intervals int) error {
+	if intervals < 0 {
+		return fmt.Errorf("Write completion intervals cannot be negative, got: %d", intervals)
+	}
+
+	m.completion = intervals
+	return nil
+}
+
+//for backends that cannot tell when files are completely written,
+//events are held back until their directories are stable
+func (m *monitor) isUnstable(ev DirEvent, unstable map[string]int) bool {
+	if _, ok := ev.(*mevent); !ok || m.completion == 0 || m.closes {
+		return false
+	}
+
+	//a directory that cannot be listed has nothing left to complete
+	if _, ok := unstable[ev.Dir()]; !ok {
+		err := m.stability.Take(ev.Dir())
+		if err != nil {
+			return false
+		}
+	}
+
+	unstable[ev.Dir()] = 0
+	return true
+}
+
+//stabilize is called every latency interval and returns the directories that
+//didn't change for the required number of them. Those that can no longer be
+//listed, for instance because they were replaced, are returned right away
+func (m *monitor) stabilize(unstable map[string]int) []string {
+	dirs := []string{}
+	for dir, n := range unstable {
+		d, err := m.stability.Diff(dir)
+		if err != nil {
+			dirs = append(dirs, dir)
+			delete(unstable, dir)
+			m.stability.Forget(dir)
+			continue
+		}
+
+		if !d.Empty() {
+			unstable[dir] = 0
+			continue
+		}
+
+		unstable[dir] = n + 1
+		if unstable[dir] >= m.completion {
+			dirs = append(dirs, dir)
+			delete(unstable, dir)
+			m.stability.Forget(dir)
+		}
+	}
+
+	return dirs
+}
@@ -0,0 +1,55 @@
+package monitor
+
+import (
+	"strings"
+)
+
+//names of files that editors write next to the file being edited:
+//backups, swap files, lock files and temporary files for atomic saves
+var editorSuffixes = []string{"~", ".swp", ".swo", ".swx", ".swpx", ".kate-swp", "___jb_tmp___", "___jb_old___"}
+var editorPrefixes = []string{".#", ".goutputstream-"}
+
+//isEditorTemp returns whether the name of a directory entry
+//looks like something an editor writes temporarily
+func isEditorTemp(name string) bool {
+	if name == "4913" {
+		return true
+	}
+
+	//emacs auto-save files
+	if len(name) > 2 && strings.HasPrefix(name, "#") && strings.HasSuffix(name, "#") {
+		return true
+	}
+
+	for _, s := range editorSuffixes {
+		if strings.HasSuffix(name, s) {
+			return true
+		}
+	}
+
+	for _, p := range editorPrefixes {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//with the editor filter, events caused by temporary editor
+//files are not emitted. Writing to a temporary file and then
+//renaming it into place is emitted once due to the rename
+func (m *monitor) isEditorTemp(ev DirEvent) bool {
+	mev, ok := ev.(*mevent)
+	if !ok || !m.editors {
+		return false
+	}
+
+	return isEditorTemp(mev.name)
+}
+
+//see WithEditorFilter()
+func (m *monitor) setEditorFilter(enabled bool) error {
+	m.editors = enabled
+	return nil
+}
@@ -0,0 +1,132 @@
+package monitor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+//emitted by monitors of a single file
+type fileEvent struct {
+	dir  string
+	path string
+}
+
+func (f *fileEvent) Dir() string  { return f.dir }
+func (f *fileEvent) Path() string { return f.path }
+
+//monitors a single file through the directory it is in, every event in
+//that directory compares what the path of the file resolves to now with
+//what it resolved to before
+type fileMonitor struct {
+	M
+	path   string
+	fi     os.FileInfo
+	events chan DirEvent
+	stop   chan struct{}
+}
+
+//NewFile creates a monitor for a single file that doesn't need to exist yet. It
+//watches the directory the file is in and emits a FileEvent whenever the file
+//the path resolves to changed: when it is written, created or removed but also
+//when it is replaced atomically or a symlink on the way to it is swapped, like
+//the '..data' link of a mounted Kubernetes ConfigMap. All other methods
+//apply to the directory the file is in
+func NewFile(path string) (M, error) {
+	fi, err := os.Stat(path)
+	if err == nil && fi.IsDir() {
+		return nil, fmt.Errorf("Failed to watch '%s': it is a directory", path)
+	}
+
+	//events are compared per file, throttling them per directory
+	//would drop changes to the file after those to its neighbours
+	m, err := New(filepath.Dir(path), NonRecursive, time.Nanosecond)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileMonitor{
+		M:      m,
+		path:   filepath.Join(m.Dir(), filepath.Base(path)),
+		events: make(chan DirEvent),
+	}, nil
+}
+
+func (f *fileMonitor) CanEmit(path string) bool {
+	return path == f.path && f.M.CanEmit(f.M.Dir())
+}
+
+func (f *fileMonitor) Events() chan DirEvent {
+	return f.events
+}
+
+func (f *fileMonitor) Start() (chan DirEvent, error) {
+	fi, _ := os.Stat(f.path)
+	_, err := f.M.Start()
+	if err != nil {
+		return f.events, err
+	}
+
+	f.fi = fi
+	f.stop = make(chan struct{})
+	go f.forward(f.stop)
+	return f.events, nil
+}
+
+func (f *fileMonitor) Stop() error {
+	//the directory might have stopped by itself when it was removed
+	if f.stop != nil {
+		close(f.stop)
+		f.stop = nil
+	}
+
+	//nothing forwards the events of the directory anymore
+	return halt(f.M)
+}
+
+//turns events of the directory into those of the file,
+//the root going away is passed on as it is
+func (f *fileMonitor) forward(stop chan struct{}) {
+	for {
+		select {
+		case ev := <-f.M.Events():
+			if _, ok := ev.(RootEvent); ok {
+				select {
+				case f.events <- ev:
+				case <-stop:
+					return
+				}
+
+				continue
+			}
+
+			fi, _ := os.Stat(f.path)
+			if !isChanged(f.fi, fi) {
+				continue
+			}
+
+			f.fi = fi
+			select {
+			case f.events <- &fileEvent{f.M.Dir(), f.path}:
+			case <-stop:
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+//a file changed when it came or went, when the path resolves to another
+//file or when the size, modification time or permissions are different
+func isChanged(prev, cur os.FileInfo) bool {
+	if prev == nil || cur == nil {
+		return prev != cur
+	}
+
+	return !os.SameFile(prev, cur) ||
+		prev.Size() != cur.Size() ||
+		!prev.ModTime().Equal(cur.ModTime()) ||
+		prev.Mode() != cur.Mode()
+}
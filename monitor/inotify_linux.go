@@ -0,0 +1,365 @@
+// +build linux
+
+package monitor
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+//the inotify instance, epoll and pipe that all monitors created with WithShared()
+//have in common. It is opened for the first of them and closed after the last
+var inotify = &manager{monitors: map[*Monitor]struct{}{}}
+
+//an event as read from an inotify instance
+type inotifyEvent struct {
+	wd     int
+	mask   uint32
+	cookie uint32
+	name   string
+}
+
+//splits what was read from an inotify instance into its events
+func parseEvents(buf []byte) []inotifyEvent {
+	evs := []inotifyEvent{}
+	var offset uint32
+	for offset <= uint32(len(buf)-syscall.SizeofInotifyEvent) {
+		raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		nbytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+raw.Len]
+		evs = append(evs, inotifyEvent{
+			wd:     int(raw.Wd),
+			mask:   uint32(raw.Mask),
+			cookie: raw.Cookie,
+			name:   strings.TrimRight(string(nbytes), "\000"),
+		})
+
+		offset += syscall.SizeofInotifyEvent + raw.Len
+	}
+
+	return evs
+}
+
+//a watch of the shared instance, with the monitors that use it and the mask
+//each of them asked for. Inotify has one watch per directory (inode) no matter
+//how many monitors watch it, it is removed once the last of them let go
+type watch struct {
+	subs map[*Monitor]uint32
+}
+
+//multiplexes monitors over a single inotify instance, events are routed by watch
+//descriptor to the monitors that use the watch. As these only add watches for the
+//directories their root and selector select, that is also all they receive
+type manager struct {
+	ifd      int
+	epfd     int
+	pipefd   []int
+	watches  map[int]*watch
+	mounts   map[int]*Monitor
+	monitors map[*Monitor]struct{}
+	sync.Mutex
+}
+
+//starts routing events to the monitor, the instance is opened when it is the first
+func (s *manager) register(m *Monitor) error {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.monitors) == 0 {
+		err := s.open()
+		if err != nil {
+			return err
+		}
+	}
+
+	s.monitors[m] = struct{}{}
+	return nil
+}
+
+//lets go of all watches of the monitor, the instance is closed when it was the last
+func (s *manager) unregister(m *Monitor) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.monitors[m]; !ok {
+		return
+	}
+
+	for wd := range s.watches {
+		s.release(m, wd)
+	}
+
+	if m.mfd >= 0 {
+		syscall.EpollCtl(s.epfd, syscall.EPOLL_CTL_DEL, m.mfd, nil)
+		delete(s.mounts, m.mfd)
+	}
+
+	delete(s.monitors, m)
+	if len(s.monitors) == 0 {
+		//the read loop closes the descriptors on its way out
+		syscall.Write(s.pipefd[1], []byte{0x00})
+		s.watches = nil
+		s.mounts = nil
+	}
+}
+
+func (s *manager) open() error {
+	ifd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return os.NewSyscallError("InotifyInit1", err)
+	}
+
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		syscall.Close(ifd)
+		return os.NewSyscallError("EpollCreate1", err)
+	}
+
+	pipefd := []int{-1, -1}
+	err = syscall.Pipe2(pipefd, syscall.O_CLOEXEC)
+	if err != nil {
+		syscall.Close(epfd)
+		syscall.Close(ifd)
+		return os.NewSyscallError("Pipe2", err)
+	}
+
+	for _, fd := range []int{ifd, pipefd[0]} {
+		err = syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, fd, &syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fd)})
+		if err != nil {
+			closeAll(ifd, epfd, pipefd[0], pipefd[1])
+			return os.NewSyscallError("EpollCtl", err)
+		}
+	}
+
+	s.ifd = ifd
+	s.epfd = epfd
+	s.pipefd = pipefd
+	s.watches = map[int]*watch{}
+	s.mounts = map[int]*Monitor{}
+	go s.read(ifd, epfd, pipefd)
+	return nil
+}
+
+//adds the monitor to the watch of a directory. The mask of the watch grows to cover
+//what every monitor asked for, each of them only receives the events it asked for
+func (s *manager) add(m *Monitor, dir string, mask uint32) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	wd, err := syscall.InotifyAddWatch(s.ifd, dir, mask|syscall.IN_MASK_ADD)
+	if err != nil {
+		return wd, err
+	}
+
+	w, ok := s.watches[wd]
+	if !ok {
+		w = &watch{subs: map[*Monitor]uint32{}}
+		s.watches[wd] = w
+	}
+
+	w.subs[m] = mask
+	return wd, nil
+}
+
+func (s *manager) remove(m *Monitor, wd int) {
+	s.Lock()
+	defer s.Unlock()
+	s.release(m, wd)
+}
+
+//removes the monitor from a watch, the watch itself is removed when no monitor
+//uses it anymore. Its mask doesn't shrink before that. Must be called with the lock
+func (s *manager) release(m *Monitor, wd int) {
+	w, ok := s.watches[wd]
+	if !ok {
+		return
+	}
+
+	delete(w.subs, m)
+	if len(w.subs) == 0 {
+		syscall.InotifyRmWatch(s.ifd, uint32(wd))
+		delete(s.watches, wd)
+	}
+}
+
+//adds the mount table of the monitor to the epoll of the instance
+func (s *manager) watchMounts(m *Monitor) error {
+	s.Lock()
+	defer s.Unlock()
+	err := syscall.EpollCtl(s.epfd, syscall.EPOLL_CTL_ADD, m.mfd, &syscall.EpollEvent{Events: syscall.EPOLLPRI, Fd: int32(m.mfd)})
+	if err != nil {
+		return os.NewSyscallError("EpollCtl", err)
+	}
+
+	s.mounts[m.mfd] = m
+	return nil
+}
+
+//reads the instance until it is closed, the descriptors are passed along such that
+//a read loop that is still on its way out never mixes with those of a new instance
+func (s *manager) read(ifd, epfd int, pipefd []int) {
+	var buf [syscall.SizeofInotifyEvent * 4096]byte
+	for {
+		epes := make([]syscall.EpollEvent, 1)
+		switch _, err := syscall.EpollWait(epfd, epes, -1); err {
+		case nil:
+			fd := int(epes[0].Fd)
+			if fd == ifd {
+				n, err := syscall.Read(ifd, buf[:])
+				if n < 0 {
+					s.fail(ifd, os.NewSyscallError("Read", err))
+				} else if n < syscall.SizeofInotifyEvent {
+					s.fail(ifd, fmt.Errorf("inotify: short read"))
+				} else {
+					s.route(ifd, parseEvents(buf[:n]))
+				}
+			} else if fd == pipefd[0] {
+				closeAll(epfd, ifd, pipefd[0], pipefd[1])
+				return
+			} else {
+				s.Lock()
+				if m, ok := s.mounts[fd]; ok {
+					m.queue.remount()
+				}
+				s.Unlock()
+			}
+		case syscall.EINTR:
+			continue
+		default:
+			s.fail(ifd, fmt.Errorf("epoll wait: %s", err))
+		}
+	}
+}
+
+//queues the events for the monitors that use their watches, unless they
+//didn't ask for that kind of change. Events that tell a watch is gone
+//(removed, unmounted) are for all of them
+func (s *manager) route(ifd int, evs []inotifyEvent) {
+	s.Lock()
+	defer s.Unlock()
+	if s.ifd != ifd {
+		return
+	}
+
+	for _, ev := range evs {
+		w, ok := s.watches[ev.wd]
+		if !ok {
+			continue
+		}
+
+		for m, mask := range w.subs {
+			kind := ev.mask & syscall.IN_ALL_EVENTS
+			if kind == 0 || kind&mask != 0 {
+				m.queue.push(ev)
+			}
+		}
+
+		//the kernel removed the watch
+		if ev.mask&syscall.IN_IGNORED != 0 {
+			delete(s.watches, ev.wd)
+		}
+	}
+}
+
+//errors of the instance concern every monitor that uses it
+func (s *manager) fail(ifd int, err error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.ifd != ifd {
+		return
+	}
+
+	for m := range s.monitors {
+		m.queue.fail(err)
+	}
+}
+
+func closeAll(fds ...int) {
+	for _, fd := range fds {
+		syscall.Close(fd)
+	}
+}
+
+//what a monitor still has to handle of the shared instance, the instance never
+//waits for a monitor such that one that is slow to handle its events doesn't
+//hold up the others
+type queue struct {
+	events  []inotifyEvent
+	errs    []error
+	mounted bool
+	wake    chan struct{}
+	sync.Mutex
+}
+
+func newQueue() *queue {
+	return &queue{wake: make(chan struct{}, 1)}
+}
+
+func (q *queue) push(ev inotifyEvent) {
+	q.Lock()
+	q.events = append(q.events, ev)
+	q.Unlock()
+	q.signal()
+}
+
+func (q *queue) fail(err error) {
+	q.Lock()
+	q.errs = append(q.errs, err)
+	q.Unlock()
+	q.signal()
+}
+
+func (q *queue) remount() {
+	q.Lock()
+	q.mounted = true
+	q.Unlock()
+	q.signal()
+}
+
+func (q *queue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+//takes everything that is queued
+func (q *queue) drain() ([]inotifyEvent, []error, bool) {
+	q.Lock()
+	defer q.Unlock()
+	evs, errs, mounted := q.events, q.errs, q.mounted
+	q.events, q.errs, q.mounted = nil, nil, false
+	return evs, errs, mounted
+}
+
+//handles what the shared instance queued for the monitor until it stops
+func (m *Monitor) dispatch() {
+	defer close(m.done)
+
+	var mv move
+	for {
+		select {
+		case <-m.queue.wake:
+		case <-m.quit:
+			err := m.close()
+			if err != nil {
+				m.fail(fmt.Errorf("Failed to close down: %s", err))
+			}
+
+			return
+		}
+
+		evs, errs, mounted := m.queue.drain()
+		for _, err := range errs {
+			m.fail(err)
+		}
+
+		for _, ev := range evs {
+			m.handle(ev, &mv)
+		}
+
+		if mounted {
+			m.handleMountChange()
+		}
+	}
+}
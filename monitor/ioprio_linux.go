@@ -0,0 +1,23 @@
+// +build linux
+
+package monitor
+
+import (
+	"runtime"
+	"syscall"
+)
+
+//@see http://man7.org/linux/man-pages/man2/ioprio_set.2.html
+const (
+	ioprioWhoProcess = 1
+	ioprioClassIdle  = 3
+	ioprioClassShift = 13
+)
+
+//puts the calling goroutine in the idle I/O scheduling class, the priority
+//belongs to the thread which is therefore locked to the goroutine. Once the
+//goroutine ends the thread ends with it and nothing else runs at idle priority
+func lowerPriority() {
+	runtime.LockOSThread()
+	syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, 0, ioprioClassIdle<<ioprioClassShift)
+}
@@ -0,0 +1,6 @@
+// +build !linux
+
+package monitor
+
+//other platforms offer no I/O priority for a single thread
+func lowerPriority() {}
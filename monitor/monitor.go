@@ -1,39 +1,119 @@
 package monitor
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/timeglass/snow/snapshot"
 )
 
-//a monitor event
+//files with this prefix are written by Flush() and never show up in
+//the events of the monitor. Backends that don't tell what entry an
+//event is for only emit events for the root when anything else changed
+var cookiePrefix = ".snow-cookie-"
+
+//how long Suppress() waits for the events of its own
+//changes to come through before it lets everything pass again
+var suppressWindow = time.Second
+
+//a monitor event, name is the entry inside the directory and op
+//the kind of change that triggered it if the backend knows them
 type mevent struct {
-	dir string
+	dir  string
+	name string
+	op   Op
 }
 
-func (m *mevent) Dir() string { return m.dir }
+func (m *mevent) Dir() string  { return m.dir }
+func (m *mevent) Name() string { return m.name }
+func (m *mevent) Op() Op       { return m.op }
+
+//emitted when a file system is mounted or unmounted at dir
+type mountEvent struct {
+	dir     string
+	mounted bool
+}
+
+func (m *mountEvent) Dir() string   { return m.dir }
+func (m *mountEvent) Mounted() bool { return m.mounted }
 
 //abstract monitor
 type monitor struct {
+	//accessed atomically, 64-bit aligned on 32-bit platforms only as the first words
+	cookie      uint64
+	missed      uint64
 	stopped     bool
 	latency     time.Duration
+	ops         Op
+	threshold   int
+	editors     bool
+	follow      bool
+	xdev        bool
+	mounts      bool
+	persist     bool
+	absent      bool
+	shallow     bool
+	self        M
+	waiting     chan struct{}
+	interval    time.Duration
+	poller      *poller
+	completion  int
+	closes      bool
+	stability   *snapshot.Snapshot
+	hashed      Selector
+	hashLimit   int64
+	contents    *snapshot.Snapshot
+	window      time.Duration
 	sel         Selector
 	dir         string
 	unthrottled chan DirEvent
 	events      chan DirEvent
 	errors      chan error
+	handler     func(err error)
 	stop        chan struct{}
+	cookies     map[string]chan error
+	suppressed  map[int][]string
+	suppressing int
+	quiets      map[int]*quiet
+	quieting    int
+	paused      bool
+	dirty       map[string]struct{}
+	resumed     []string
+	wake        chan struct{}
+	state       string
+	epoch       string
+	clock       uint64
+	changed     map[string]uint64
+	offline     chan []string
+	verifier    *verifier
+	verifyEvery time.Duration
+	adaptive    bool
+	notices     uint64
+	noticed     map[string]uint64
+	sparse      *sparse
+	shared      bool
+	rootlist    *snapshot.Snapshot
+	mu          sync.Mutex
 }
 
 func newMonitor(dir string, sel Selector, latency time.Duration) (*monitor, error) {
-	rdir, err := filepath.EvalSymlinks(dir)
+	rdir, err := resolve(dir)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to eval symlink for '%s': %s", dir, err)
 	}
 
 	return &monitor{
 		latency:     latency,
+		ops:         DefaultOps,
 		sel:         sel,
 		dir:         rdir,
 		stopped:     true,
@@ -41,16 +121,100 @@ func newMonitor(dir string, sel Selector, latency time.Duration) (*monitor, erro
 		events:      make(chan DirEvent),
 		errors:      make(chan error),
 		stop:        make(chan struct{}),
+		cookies:     map[string]chan error{},
+		suppressed:  map[int][]string{},
+		quiets:      map[int]*quiet{},
+		dirty:       map[string]struct{}{},
+		wake:        make(chan struct{}, 1),
+		epoch:       newEpoch(),
+		changed:     map[string]uint64{},
+		noticed:     map[string]uint64{},
 	}, nil
 }
 
 func (m *monitor) throttle() {
+	var st *storm
+	var calm <-chan time.Time
+	if m.threshold > 0 {
+		st = newStorm(m.threshold, m.window)
+	}
+
+	var tick <-chan time.Time
+	unstable := map[string]int{}
+	if m.completion > 0 && !m.closes {
+		m.stability = snapshot.New()
+		ticker := time.NewTicker(m.latency)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	//changes made while not running come first, see WithState()
+	if m.offline != nil {
+		select {
+		case dirs := <-m.offline:
+			for _, dir := range dirs {
+				m.send(&mevent{dir, "", 0})
+			}
+		case <-m.stop:
+			return
+		}
+	}
+
 	throttles := map[string]time.Time{}
 	for {
 		select {
 		case <-m.stop:
 			return
+		case <-calm:
+			calm = nil
+			m.send(st.end())
+		case <-tick:
+			for _, dir := range m.stabilize(unstable) {
+				m.send(&mevent{dir, "", 0})
+				throttles[dir] = time.Now().Add(m.latency)
+			}
+		case <-m.wake:
+			m.mu.Lock()
+			dirs := m.resumed
+			m.resumed = nil
+			m.mu.Unlock()
+
+			//changes that accumulated during a pause are not throttled
+			for _, dir := range dirs {
+				m.touch(dir)
+				m.send(&mevent{dir, "", 0})
+				throttles[dir] = time.Now().Add(m.latency)
+			}
 		case ev := <-m.unthrottled:
+			m.notice(ev.Dir())
+			m.activate(ev)
+
+			//the root going away is always reported, also while paused
+			if _, ok := ev.(RootEvent); ok {
+				m.send(ev)
+				continue
+			}
+
+			if m.isCookie(ev) || m.isIgnoredOp(ev) || m.isEditorTemp(ev) || m.isSuppressed(ev) || m.isPaused(ev) {
+				continue
+			}
+
+			//changes of mounts are neither throttled nor part of a storm
+			m.touch(ev.Dir())
+			if _, ok := ev.(MountEvent); ok {
+				m.send(ev)
+				continue
+			}
+
+			if m.isUnstable(ev, unstable) {
+				continue
+			}
+
+			if st != nil && st.add(ev.Dir(), time.Now()) {
+				calm = time.After(st.window)
+				continue
+			}
+
 			if until, ok := throttles[ev.Dir()]; ok {
 				diff := until.Sub(time.Now())
 				if diff > 0 {
@@ -58,12 +222,362 @@ func (m *monitor) throttle() {
 				}
 			}
 
-			m.events <- ev
+			//not throttled, the next raw event might carry the actual change
+			if m.isUnchanged(ev) {
+				continue
+			}
+
+			m.send(ev)
 			throttles[ev.Dir()] = time.Now().Add(m.latency)
 		}
 	}
 }
 
+//cookie events are never emitted, if someone is waiting
+//for it in Flush() it is notified of its arrival
+func (m *monitor) isCookie(ev DirEvent) bool {
+	mev, ok := ev.(*mevent)
+	if !ok {
+		return false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if canName || mev.name != "" || mev.dir != m.dir {
+		if arrived, ok := m.cookies[mev.name]; ok {
+			arrived <- nil
+			delete(m.cookies, mev.name)
+		}
+
+		return strings.HasPrefix(mev.name, cookiePrefix)
+	}
+
+	//some backends (fsevents) don't know what entry caused the event, a cookie
+	//arrived with the event for the root that first lists its file. The event
+	//is only emitted when anything but cookies changed in the root as well
+	d, err := m.rootlist.Diff(m.dir)
+	if err != nil {
+		return false
+	}
+
+	for _, e := range d.Created {
+		if arrived, ok := m.cookies[e.Name]; ok {
+			arrived <- nil
+			delete(m.cookies, e.Name)
+		}
+	}
+
+	return onlyCookies(d)
+}
+
+//whether nothing but cookies changed in a directory
+func onlyCookies(d *snapshot.Diff) bool {
+	for _, e := range append(append(d.Created, d.Removed...), d.Modified...) {
+		if !strings.HasPrefix(e.Name, cookiePrefix) {
+			return false
+		}
+	}
+
+	for _, r := range d.Renamed {
+		if !strings.HasPrefix(r.From.Name, cookiePrefix) || !strings.HasPrefix(r.To.Name, cookiePrefix) {
+			return false
+		}
+	}
+
+	return true
+}
+
+//events caused by changes inside a Suppress() call are not emitted
+func (m *monitor) isSuppressed(ev DirEvent) bool {
+	mev, ok := ev.(*mevent)
+	if !ok {
+		return false
+	}
+
+	path := mev.dir
+	if mev.name != "" {
+		path = filepath.Join(mev.dir, mev.name)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, paths := range m.suppressed {
+		for _, p := range paths {
+			if path == p || strings.HasPrefix(path, p+string(filepath.Separator)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+//Suppress runs fn and filters out the events for changes it makes to the given
+//files or directories, it waits for those events to be observed before it returns
+//such that changes made concurrently by others to other paths still come through
+func (m *monitor) Suppress(paths []string, fn func() error) error {
+	if m.stopped == true {
+		return ErrAlreadyStopped
+	}
+
+	cleaned := []string{}
+	for _, p := range paths {
+		rp, err := resolveParent(p)
+		if err != nil {
+			return fmt.Errorf("Failed to resolve path '%s': %s", p, err)
+		}
+
+		cleaned = append(cleaned, rp)
+	}
+
+	m.mu.Lock()
+	m.suppressing++
+	id := m.suppressing
+	m.suppressed[id] = cleaned
+	m.mu.Unlock()
+
+	defer func() {
+		m.mu.Lock()
+		delete(m.suppressed, id)
+		m.mu.Unlock()
+	}()
+
+	err := fn()
+
+	ctx, cancel := context.WithTimeout(context.Background(), suppressWindow)
+	defer cancel()
+
+	ferr := m.Flush(ctx)
+	if err != nil {
+		return err
+	}
+
+	if ferr != nil && ferr != context.DeadlineExceeded {
+		return ferr
+	}
+
+	return nil
+}
+
+//while paused, events only mark their directory as dirty
+func (m *monitor) isPaused(ev DirEvent) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.paused {
+		return false
+	}
+
+	m.dirty[ev.Dir()] = struct{}{}
+	return true
+}
+
+//see WithStorm()
+func (m *monitor) setStorm(threshold int, window time.Duration) error {
+	if threshold < 0 {
+		return fmt.Errorf("Storm threshold cannot be negative, got: %d", threshold)
+	}
+
+	if threshold > 0 && window <= 0 {
+		return fmt.Errorf("Storm window must be positive, got: %s", window)
+	}
+
+	m.threshold = threshold
+	m.window = window
+	return nil
+}
+
+//see WithContentFilter()
+func (m *monitor) setContentFilter(sel Selector, limit int64) error {
+	if limit <= 0 {
+		return fmt.Errorf("Content hash limit must be positive, got: %d", limit)
+	}
+
+	if sel == nil {
+		sel = Recursive
+	}
+
+	m.hashed = sel
+	m.hashLimit = limit
+	return nil
+}
+
+//prime the hashes of all directories that are subject to the content filter
+func (m *monitor) primeContents() error {
+	m.contents = snapshot.New()
+	m.contents.HashLimit = m.hashLimit
+	return filepath.Walk(m.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !fi.IsDir() || !m.isHashed(path) {
+			return nil
+		}
+
+		return m.contents.Take(path)
+	})
+}
+
+func (m *monitor) isHashed(dir string) bool {
+	if res, err := m.IsSelected(dir); !res || err != nil {
+		return false
+	}
+
+	res, err := m.hashed(m.dir, filepath.Clean(dir))
+	return res && err == nil
+}
+
+//with a content filter, events for directories of which the
+//content is identical to what it was before are not emitted
+func (m *monitor) isUnchanged(ev DirEvent) bool {
+	if _, ok := ev.(*mevent); !ok || m.hashed == nil || !m.isHashed(ev.Dir()) {
+		return false
+	}
+
+	d, err := m.contents.Diff(ev.Dir())
+	if err != nil {
+		return false
+	}
+
+	return d.Empty()
+}
+
+//see WithFollowSymlinks()
+func (m *monitor) setFollowSymlinks(enabled bool) error {
+	if enabled && !canFollow {
+		return fmt.Errorf("Following symlinks is not supported on %s", runtime.GOOS)
+	}
+
+	m.follow = enabled
+	return nil
+}
+
+//see WithSameFilesystem()
+func (m *monitor) setSameFilesystem(enabled bool) error {
+	if enabled && !canMount {
+		return fmt.Errorf("Detecting mount points is not supported on %s", runtime.GOOS)
+	}
+
+	m.xdev = enabled
+	return nil
+}
+
+//see WithMountWatch()
+func (m *monitor) setMountWatch(enabled bool) error {
+	if enabled && !canWatchMounts {
+		return fmt.Errorf("Watching mounts is not supported on %s", runtime.GOOS)
+	}
+
+	m.mounts = enabled
+	return nil
+}
+
+//see WithShared()
+func (m *monitor) setShared(enabled bool) error {
+	if enabled && !canShare {
+		return fmt.Errorf("Sharing the backend is not supported on %s", runtime.GOOS)
+	}
+
+	m.shared = enabled
+	return nil
+}
+
+//see WithPollFallback()
+func (m *monitor) setPollFallback(interval time.Duration) error {
+	if interval < 0 {
+		return fmt.Errorf("Poll interval cannot be negative, got: %s", interval)
+	}
+
+	if interval > 0 && !canMount {
+		return fmt.Errorf("Detecting file systems is not supported on %s", runtime.GOOS)
+	}
+
+	m.interval = interval
+	return nil
+}
+
+//Pause stops the emitting of events without removing any of
+//the underlying watches, directories that change in the meantime
+//are remembered until Resume() is called
+func (m *monitor) Pause() error {
+	if m.stopped == true {
+		return ErrAlreadyStopped
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.paused {
+		return ErrAlreadyPaused
+	}
+
+	m.paused = true
+	return nil
+}
+
+//Resume emits a single event for each directory that changed while
+//the monitor was paused, unless it is asked to discard them
+func (m *monitor) Resume(discard bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.paused {
+		return ErrNotPaused
+	}
+
+	if !discard {
+		dirs := []string{}
+		for dir := range m.dirty {
+			dirs = append(dirs, dir)
+		}
+
+		sort.Strings(dirs)
+		m.resumed = append(m.resumed, dirs...)
+		select {
+		case m.wake <- struct{}{}:
+		default:
+		}
+	}
+
+	m.paused = false
+	m.dirty = map[string]struct{}{}
+	return nil
+}
+
+//Flush blocks until all changes that happened before it was called are
+//delivered or coalesced, it does so by writing a cookie file into the root
+//directory and waiting for its event to come through
+func (m *monitor) Flush(ctx context.Context) error {
+	if m.stopped == true {
+		return ErrAlreadyStopped
+	}
+
+	name := fmt.Sprintf("%s%d-%d", cookiePrefix, os.Getpid(), atomic.AddUint64(&m.cookie, 1))
+	arrived := make(chan error, 1)
+
+	m.mu.Lock()
+	m.cookies[name] = arrived
+	m.mu.Unlock()
+
+	defer func() {
+		m.mu.Lock()
+		delete(m.cookies, name)
+		m.mu.Unlock()
+	}()
+
+	path := filepath.Join(m.dir, name)
+	err := ioutil.WriteFile(path, nil, 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to write cookie '%s': %s", path, err)
+	}
+
+	defer os.Remove(path)
+	select {
+	case err := <-arrived:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (m *monitor) CanEmit(path string) bool {
 	if m.stopped == true {
 		return false
@@ -81,11 +595,17 @@ func (m *monitor) CanEmit(path string) bool {
 }
 
 func (m *monitor) IsSelected(path string) (bool, error) {
-	res, err := m.sel(m.dir, filepath.Clean(path))
+	path = filepath.Clean(path)
+	res, err := m.sel(m.dir, path)
 	if err != nil {
 		return false, err
 	}
 
+	//in sparse mode only what is expanded is watched
+	if res && m.sparse != nil {
+		return m.sparse.has(path), nil
+	}
+
 	return res, nil
 }
 
@@ -93,6 +613,16 @@ func (m *monitor) Events() chan DirEvent {
 	return m.events
 }
 
+//errors go to the error handler if there is one
+func (m *monitor) fail(err error) {
+	if m.handler != nil {
+		m.handler(err)
+		return
+	}
+
+	m.errors <- err
+}
+
 func (m *monitor) Errors() chan error {
 	return m.errors
 }
@@ -102,8 +632,37 @@ func (m *monitor) Start() error {
 		return ErrAlreadyStarted
 	}
 
+	//starting explicitly ends waiting for a persistent root
+	m.unwait()
+	if m.hashed != nil {
+		err := m.primeContents()
+		if err != nil {
+			return fmt.Errorf("Failed to hash contents of '%s': %s", m.dir, err)
+		}
+	}
+
+	//without entry names cookies are told apart by the listing of the root
+	if !canName {
+		m.rootlist = snapshot.New()
+		m.rootlist.Take(m.dir)
+	}
+
 	m.stopped = false
 	m.unthrottled = make(chan DirEvent)
+	m.offline = nil
+	if m.state != "" {
+		m.offline = make(chan []string, 1)
+	}
+
+	if m.interval > 0 {
+		m.poller = newPoller(m, m.interval)
+	}
+
+	m.verifier = nil
+	if m.verifyEvery > 0 {
+		m.verifier = newVerifier(m, m.verifyEvery, m.adaptive)
+		go m.verifier.run()
+	}
 
 	go m.throttle()
 	return nil
@@ -116,6 +675,30 @@ func (m *monitor) Stop() error {
 
 	m.stop <- struct{}{}
 	m.stopped = true
+	if m.poller != nil {
+		m.poller.close()
+	}
+
+	if m.verifier != nil {
+		m.verifier.close()
+	}
+
+	//nobody is going to deliver cookies anymore
+	m.mu.Lock()
+	m.paused = false
+	m.dirty = map[string]struct{}{}
+	m.resumed = nil
+	for name, arrived := range m.cookies {
+		arrived <- ErrAlreadyStopped
+		delete(m.cookies, name)
+	}
+
+	for id, q := range m.quiets {
+		q.done <- ErrAlreadyStopped
+		delete(m.quiets, id)
+	}
+	m.mu.Unlock()
+
 	return nil
 }
 
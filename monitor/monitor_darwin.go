@@ -8,6 +8,25 @@ import (
 	"github.com/timeglass/snow/_vendor/github.com/go-fsnotify/fsevents"
 )
 
+//fsevents only tells us something happened in a directory,
+//there is no way of observing when files are read
+var supportedOps = Create | Write | Remove | Rename | Attrib
+
+//fsevents doesn't report changes in the targets of symlinks
+var canFollow = false
+
+//fsevents takes care of mount points itself
+var canMount = false
+
+//there is no mount table to watch
+var canWatchMounts = false
+
+//fsevents only tells what directory an event is for
+var canName = false
+
+//there is nothing to share between monitors
+var canShare = false
+
 type Monitor struct {
 	es *fsevents.EventStream
 	*monitor
@@ -27,6 +46,10 @@ func new(dir string, sel Selector, latency time.Duration) (*Monitor, error) {
 }
 
 func (m *Monitor) Start() (chan DirEvent, error) {
+	if m.awaitRoot() {
+		return m.Events(), nil
+	}
+
 	err := m.monitor.Start()
 	if err != nil {
 		return m.Events(), err
@@ -44,28 +67,33 @@ func (m *Monitor) Start() (chan DirEvent, error) {
 			for _, ev := range msg {
 				res, err := m.IsSelected(ev.Path)
 				if err != nil {
-					m.errors <- err
+					m.fail(err)
 					continue
 				}
 
 				//for fsevent, only emit
 				//events that match selector
 				if res {
-					m.unthrottled <- &mevent{ev.Path}
+					m.unthrottled <- &mevent{ev.Path, "", 0}
 				}
 
-				//for now, just stop when the root changed (deleted/moved)
-				if ev.Flags&fsevents.RootChanged == fsevents.RootChanged {
-					m.Stop()
+				//the root was removed or moved, fsevents doesn't tell which
+				if ev.Flags&fsevents.RootChanged == fsevents.RootChanged && !m.stopped {
+					m.gone(RootRemoved)
 				}
 			}
 		}
 	}()
 
+	m.replay()
 	return m.Events(), nil
 }
 
 func (m *Monitor) Stop() error {
+	if m.unwait() {
+		return nil
+	}
+
 	err := m.monitor.Stop()
 	if err != nil {
 		return err
@@ -78,5 +106,5 @@ func (m *Monitor) Stop() error {
 	//@todo without closing, the program will leak goroutines
 	close(m.es.Events)
 
-	return nil
+	return m.save()
 }
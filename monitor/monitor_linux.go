@@ -11,15 +11,52 @@ import (
 	"sync"
 	"syscall"
 	"time"
-	"unsafe"
 )
 
+var supportedOps = Create | Write | Remove | Rename | Attrib | Access
+
+//inotify watches the target of symlinks
+var canFollow = true
+
+//statfs tells us on what file system a directory is
+var canMount = true
+
+//the kernel signals changes to the mount table through /proc/self/mountinfo
+var canWatchMounts = true
+
+//inotify tells what entry an event is for
+var canName = true
+
+//monitors can share one inotify instance
+var canShare = true
+
+//file systems on which inotify misses changes, for instance because
+//they are made on other machines or in another layer of the file system
+var unreliableFS = map[uint32]string{
+	0x6969:     "nfs",
+	0x517b:     "smb",
+	0xff534d42: "cifs",
+	0xfe534d42: "smb2",
+	0x65735546: "fuse",
+	0x794c7630: "overlay",
+	0x01021997: "9p",
+}
+
 type Monitor struct {
-	ifd    int
-	epfd   int
-	pipefd []int
-	epes   []syscall.EpollEvent
-	paths  map[int]string
+	ifd         int
+	epfd        int
+	mfd         int
+	pipefd      []int
+	epes        []syscall.EpollEvent
+	paths       map[int][]string
+	seen        map[[2]uint64]string
+	dev         uint64
+	fs          map[uint64]bool
+	mountpoints map[string]string
+	created     map[string]bool
+	queue       *queue
+	done        chan struct{}
+	quit        chan struct{}
 	*monitor
 	sync.Mutex
 }
@@ -30,11 +67,17 @@ func new(dir string, sel Selector, latency time.Duration) (*Monitor, error) {
 		return nil, err
 	}
 
+	//inotify tells us when files are closed after writing
+	mon.closes = true
 	m := &Monitor{
-		pipefd:  []int{-1, -1},
-		paths:   map[int]string{},
-		epes:    []syscall.EpollEvent{},
-		monitor: mon,
+		mfd:         -1,
+		pipefd:      []int{-1, -1},
+		paths:       map[int][]string{},
+		seen:        map[[2]uint64]string{},
+		epes:        []syscall.EpollEvent{},
+		mountpoints: map[string]string{},
+		created:     map[string]bool{},
+		monitor:     mon,
 	}
 
 	return m, nil
@@ -44,6 +87,11 @@ func (m *Monitor) close() error {
 	m.Lock()
 	defer m.Unlock()
 
+	if m.shared {
+		inotify.unregister(m)
+		return m.closeMounts()
+	}
+
 	err := syscall.Close(m.epfd)
 	if err != nil {
 		return os.NewSyscallError("Close", err)
@@ -59,6 +107,11 @@ func (m *Monitor) close() error {
 		return os.NewSyscallError("Close", err)
 	}
 
+	err = m.closeMounts()
+	if err != nil {
+		return err
+	}
+
 	err = syscall.Close(m.pipefd[1])
 	if err != nil {
 		return os.NewSyscallError("Close", err)
@@ -68,6 +121,20 @@ func (m *Monitor) close() error {
 }
 
 func (m *Monitor) init() error {
+	if m.shared {
+		m.queue = newQueue()
+		err := inotify.register(m)
+		if err != nil {
+			return err
+		}
+
+		if m.mounts {
+			return m.watchMounts()
+		}
+
+		return nil
+	}
+
 	var err error
 	m.ifd, err = syscall.InotifyInit()
 	if err != nil {
@@ -99,6 +166,10 @@ func (m *Monitor) init() error {
 		return os.NewSyscallError("EpollCtl", err)
 	}
 
+	if m.mounts {
+		return m.watchMounts()
+	}
+
 	return nil
 }
 
@@ -117,15 +188,392 @@ func (m *Monitor) addWatch(dir string) error {
 	// (perhaps via a different link to the same object), then the
 	// descriptor for the existing watch is returned
 	// @see http://man7.org/linux/man-pages/man2/inotify_add_watch.2.html
-	wfd, err := syscall.InotifyAddWatch(m.ifd, dir, syscall.IN_MOVE_SELF|syscall.IN_DELETE_SELF|syscall.IN_CREATE|syscall.IN_DELETE|syscall.IN_MODIFY|syscall.IN_MOVED_FROM|syscall.IN_MOVED_TO|syscall.IN_ONLYDIR)
+	wfd, err := m.addInotify(dir)
 	if err != nil {
 		return os.NewSyscallError("InotifyAddWatch", err)
 	}
 
-	m.paths[wfd] = dir
+	m.addPath(wfd, dir)
 	return nil
 }
 
+//adds a watch to the own inotify instance or the shared one, see WithShared()
+func (m *Monitor) addInotify(dir string) (int, error) {
+	if m.shared {
+		return inotify.add(m, dir, m.mask())
+	}
+
+	return syscall.InotifyAddWatch(m.ifd, dir, m.mask())
+}
+
+func (m *Monitor) rmInotify(wfd int) {
+	if m.shared {
+		inotify.remove(m, wfd)
+		return
+	}
+
+	syscall.InotifyRmWatch(m.ifd, uint32(wfd))
+}
+
+//the watch table keeps every path under which a watched directory is visible,
+//inotify returns the same descriptor for each of them. Must be called with the lock
+func (m *Monitor) addPath(wfd int, dir string) {
+	for _, p := range m.paths[wfd] {
+		if p == dir {
+			return
+		}
+	}
+
+	m.paths[wfd] = append(m.paths[wfd], dir)
+}
+
+//removes a single path from the watch table and returns the descriptor it belonged
+//to, the descriptor is forgotten when it has no paths left. Must be called with the lock
+func (m *Monitor) removePath(dir string) int {
+	for fd, paths := range m.paths {
+		for i, p := range paths {
+			if p != dir {
+				continue
+			}
+
+			m.paths[fd] = append(paths[:i:i], paths[i+1:]...)
+			if len(m.paths[fd]) == 0 {
+				delete(m.paths, fd)
+			}
+
+			return fd
+		}
+	}
+
+	return 0
+}
+
+//returns whether a path is in the watch table. Must be called with the lock
+func (m *Monitor) hasPath(dir string) bool {
+	for _, paths := range m.paths {
+		for _, p := range paths {
+			if p == dir {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+//creations, removals and moves are always watched to keep track
+//of directories, others depend on the kinds of changes observed. In
+//write completion mode files are reported when they are closed
+//after writing instead of on each modification, opens tell what
+//newly created files are about to be written
+func (m *Monitor) mask() uint32 {
+	mask := uint32(syscall.IN_MOVE_SELF | syscall.IN_DELETE_SELF | syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ONLYDIR)
+	if m.ops&Write != 0 && m.completion > 0 {
+		mask |= syscall.IN_CLOSE_WRITE | syscall.IN_OPEN
+	} else if m.ops&Write != 0 {
+		mask |= syscall.IN_MODIFY
+	}
+
+	if m.ops&Attrib != 0 {
+		mask |= syscall.IN_ATTRIB
+	}
+
+	if m.ops&Access != 0 {
+		mask |= syscall.IN_ACCESS | syscall.IN_OPEN
+	}
+
+	return mask
+}
+
+func opOf(mask uint32) Op {
+	var op Op
+	if mask&syscall.IN_CREATE != 0 {
+		op |= Create
+	}
+
+	if mask&(syscall.IN_MODIFY|syscall.IN_CLOSE_WRITE) != 0 {
+		op |= Write
+	}
+
+	if mask&syscall.IN_DELETE != 0 {
+		op |= Remove
+	}
+
+	if mask&(syscall.IN_MOVED_FROM|syscall.IN_MOVED_TO) != 0 {
+		op |= Rename
+	}
+
+	if mask&syscall.IN_ATTRIB != 0 {
+		op |= Attrib
+	}
+
+	if mask&(syscall.IN_ACCESS|syscall.IN_OPEN) != 0 {
+		op |= Access
+	}
+
+	return op
+}
+
+//in write completion mode the creation of a regular file is not reported, it
+//will be once the file is closed after writing to it. Files that are not opened
+//right after they are created, such as hard links, are reported after an interval
+func (m *Monitor) isIncomplete(mask uint32, dir, name string) bool {
+	if m.completion == 0 || mask&syscall.IN_ISDIR == syscall.IN_ISDIR {
+		return false
+	}
+
+	path := filepath.Join(dir, name)
+	if mask&(syscall.IN_CLOSE_WRITE|syscall.IN_OPEN) != 0 {
+		m.Lock()
+		defer m.Unlock()
+		if _, ok := m.created[path]; ok {
+			m.created[path] = mask&syscall.IN_OPEN != 0
+		}
+
+		if mask&syscall.IN_CLOSE_WRITE != 0 {
+			delete(m.created, path)
+		}
+
+		return false
+	}
+
+	if mask&syscall.IN_CREATE != syscall.IN_CREATE {
+		return false
+	}
+
+	fi, err := os.Lstat(path)
+	if err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
+
+	m.Lock()
+	m.created[path] = false
+	m.Unlock()
+	time.AfterFunc(m.latency, func() { m.settle(dir, name) })
+	return true
+}
+
+//reports a created file that nobody opened within an interval, there
+//won't be a close after writing to it that would report it otherwise
+func (m *Monitor) settle(dir, name string) {
+	path := filepath.Join(dir, name)
+	m.Lock()
+	opened, ok := m.created[path]
+	if ok && !opened {
+		delete(m.created, path)
+	}
+	m.Unlock()
+
+	if ok && !opened && !m.stopped {
+		m.emit(&mevent{dir, name, Create})
+	}
+}
+
+//walk is filepath.Walk unless symlinks are followed, then symlinked directories
+//are walked as well under the path of the link. A link to a directory in the
+//tree, or to one that is already walked through another link, is only watched
+//as an alias of that directory: the directory itself is always watched under
+//its own path such that removing the link never unwatches it. This also
+//prevents cycles
+func (m *Monitor) walk(dir string, fn filepath.WalkFunc) error {
+	if !m.follow {
+		return filepath.Walk(dir, fn)
+	}
+
+	lfi, err := os.Lstat(dir)
+	if err != nil {
+		return fn(dir, nil, err)
+	}
+
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return fn(dir, nil, err)
+	}
+
+	return m.walkFollow(dir, fi, lfi.Mode()&os.ModeSymlink == os.ModeSymlink, m.isAlias, fn)
+}
+
+//walks the tree the way the watches are added but without adding any, it
+//doesn't descend into directories that are on another file system than the
+//root when only that is monitored. See walkSelected()
+func (m *Monitor) walkTree(root string, fn filepath.WalkFunc) error {
+	var st syscall.Stat_t
+	err := syscall.Stat(m.dir, &st)
+	if err != nil {
+		return fn(root, nil, err)
+	}
+
+	dev := uint64(st.Dev)
+	within := func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.IsDir() && m.xdev {
+			if st, ok := fi.Sys().(*syscall.Stat_t); ok && uint64(st.Dev) != dev {
+				return filepath.SkipDir
+			}
+		}
+
+		return fn(path, fi, err)
+	}
+
+	if !m.follow {
+		return filepath.Walk(root, within)
+	}
+
+	lfi, err := os.Lstat(root)
+	if err != nil {
+		return fn(root, nil, err)
+	}
+
+	fi, err := os.Stat(root)
+	if err != nil {
+		return fn(root, nil, err)
+	}
+
+	//the same aliases as those of the watches, without touching them
+	seen := map[[2]uint64]string{}
+	alias := func(path string, fi os.FileInfo, link bool) bool {
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return false
+		}
+
+		key := [2]uint64{uint64(st.Dev), uint64(st.Ino)}
+		if _, ok := seen[key]; link && (ok || m.linksIntoTree(path)) {
+			return true
+		}
+
+		seen[key] = path
+		return false
+	}
+
+	return m.walkFollow(root, fi, lfi.Mode()&os.ModeSymlink == os.ModeSymlink, alias, within)
+}
+
+func (m *Monitor) walkFollow(path string, fi os.FileInfo, link bool, alias func(string, os.FileInfo, bool) bool, fn filepath.WalkFunc) error {
+	err := fn(path, fi, nil)
+	if err != nil || !fi.IsDir() || alias(path, fi, link) {
+		return err
+	}
+
+	fis, err := ioutil.ReadDir(path)
+	if err != nil {
+		return fn(path, fi, err)
+	}
+
+	for _, sub := range fis {
+		subpath := filepath.Join(path, sub.Name())
+		sublink := sub.Mode()&os.ModeSymlink == os.ModeSymlink
+		if sublink {
+			sub, err = os.Stat(subpath)
+			if err != nil {
+				//dangling links are of no interest
+				continue
+			}
+		}
+
+		err = m.walkFollow(subpath, sub, sublink, alias, fn)
+		if err != nil && err != filepath.SkipDir {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//returns whether a linked directory is watched as an alias of a directory
+//in the tree or of one that is already watched under another path, instead
+//of walking it under the path of the link
+func (m *Monitor) isAlias(path string, fi os.FileInfo, link bool) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+
+	key := [2]uint64{uint64(st.Dev), uint64(st.Ino)}
+	if link && m.linksIntoTree(path) {
+		return true
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	if prev, ok := m.seen[key]; ok && link && prev != path && m.hasPath(prev) {
+		return true
+	}
+
+	m.seen[key] = path
+	return false
+}
+
+//returns whether the target of a link is in the tree, it is walked under its own path
+func (m *Monitor) linksIntoTree(link string) bool {
+	root, err := filepath.EvalSymlinks(m.Dir())
+	if err != nil {
+		return false
+	}
+
+	target, err := filepath.EvalSymlinks(link)
+	if err != nil {
+		return false
+	}
+
+	return target == root || strings.HasPrefix(target, root+string(filepath.Separator))
+}
+
+//returns whether the walk should not descend into a directory because it is
+//on another file system than the root and only the root file system is
+//monitored, or because its file system doesn't notify and is polled instead
+func (m *Monitor) isBoundary(path string, fi os.FileInfo) (bool, error) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false, nil
+	}
+
+	dev := uint64(st.Dev)
+	if m.xdev && dev != m.dev {
+		return true, nil
+	}
+
+	if m.poller == nil {
+		return false, nil
+	}
+
+	unreliable, ok := m.fs[dev]
+	if !ok {
+		var sfs syscall.Statfs_t
+		err := syscall.Statfs(path, &sfs)
+		if err != nil {
+			return false, os.NewSyscallError("Statfs", err)
+		}
+
+		_, unreliable = unreliableFS[uint32(sfs.Type)]
+		m.fs[dev] = unreliable
+	}
+
+	if !unreliable {
+		return false, nil
+	}
+
+	return true, m.poller.add(path)
+}
+
+//remove the watches for a directory and everything below it, watches
+//that are still visible under other paths are kept
+func (m *Monitor) unwatch(dir string) {
+	m.Lock()
+	defer m.Unlock()
+	for fd, paths := range m.paths {
+		for _, path := range paths {
+			if path != dir && !strings.HasPrefix(path, dir+string(filepath.Separator)) {
+				continue
+			}
+
+			m.removePath(path)
+			if _, ok := m.paths[fd]; !ok {
+				m.rmInotify(fd)
+			}
+		}
+	}
+}
+
 // directory creation under linux requires some fake events
 // at the time of finotify read() some sub files or directories
 // may already be created, as such we walk the new directory recursively
@@ -140,19 +588,27 @@ func (m *Monitor) handleDirCreation(dir string) error {
 	}
 
 	//walk subdirectories that could have been created
-	err = filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+	err = m.walk(dir, func(path string, fi os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
 		if fi.IsDir() {
+			if skip, err := m.isBoundary(path, fi); skip || err != nil {
+				if err != nil {
+					return err
+				}
+
+				return filepath.SkipDir
+			}
+
 			fis, err := ioutil.ReadDir(path)
 			if err != nil {
 				return fmt.Errorf("Failed read dir '%s': %s", path, err)
 			}
 
 			if len(fis) > 0 {
-				m.unthrottled <- &mevent{path}
+				m.emit(&mevent{path, "", Create})
 			}
 
 			err = m.addWatch(path)
@@ -175,7 +631,7 @@ func (m *Monitor) handleDirCreation(dir string) error {
 	}
 
 	if len(fis) > 0 {
-		m.unthrottled <- &mevent{dir}
+		m.emit(&mevent{dir, "", Create})
 	}
 
 	//add the newly created dir itself
@@ -187,213 +643,350 @@ func (m *Monitor) handleDirCreation(dir string) error {
 	return nil
 }
 
+//watches a directory and everything below it
+func (m *Monitor) watchTree(dir string) error {
+	return m.walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() {
+			if m.shallow && path != m.dir {
+				return filepath.SkipDir
+			}
+
+			if skip, err := m.isBoundary(path, fi); skip || err != nil {
+				if err != nil {
+					return err
+				}
+
+				return filepath.SkipDir
+			}
+
+			err = m.addWatch(path)
+			if err != nil {
+				return fmt.Errorf("Failed to add '%s': %s", path, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+//in sparse mode only the expanded directories are watched, those
+//that don't exist (anymore) are once they are created
+func (m *Monitor) watchSparse() error {
+	for _, dir := range m.sparse.dirs() {
+		if !isDir(dir) {
+			continue
+		}
+
+		err := m.addWatch(dir)
+		if err != nil {
+			return fmt.Errorf("Failed to add '%s': %s", dir, err)
+		}
+	}
+
+	return nil
+}
+
+func (m *Monitor) watchDir(dir string) error {
+	return m.addWatch(dir)
+}
+
+//removes the watch of a single directory, unlike unwatch()
+func (m *Monitor) unwatchDir(dir string) {
+	m.Lock()
+	defer m.Unlock()
+	fd := m.removePath(dir)
+	if _, ok := m.paths[fd]; fd != 0 && !ok {
+		m.rmInotify(fd)
+	}
+}
+
+//hands an event to the throttle, unless the monitor stopped in the meantime
+func (m *Monitor) emit(ev DirEvent) {
+	select {
+	case m.unthrottled <- ev:
+	case <-m.quit:
+	}
+}
+
 func (m *Monitor) CanEmit(path string) bool {
 	if res, err := m.IsSelected(path); !res || err != nil {
 		return false
 	}
 
-	m.Lock()
-	defer m.Unlock()
-	for _, p := range m.paths {
-		if p == path {
-			return true
-		}
+	if m.poller != nil && m.poller.has(path) {
+		return true
 	}
 
-	return false
+	m.Lock()
+	defer m.Unlock()
+	return m.hasPath(path)
 }
 
 func (m *Monitor) Stop() error {
+	if m.unwait() {
+		return nil
+	}
+
 	err := m.monitor.Stop()
 	if err != nil {
 		return err
 	}
 
-	_, err = syscall.Write(m.pipefd[1], []byte{0x00})
-	if err != nil {
-		return os.NewSyscallError("Write", err)
+	//with the shared instance the quit channel is all it takes
+	close(m.quit)
+	if !m.shared {
+		_, err = syscall.Write(m.pipefd[1], []byte{0x00})
+		if err != nil {
+			return os.NewSyscallError("Write", err)
+		}
 	}
 
+	m.Lock()
 	for fd, _ := range m.paths {
 		delete(m.paths, fd)
 	}
 
-	return nil
+	m.created = map[string]bool{}
+	m.Unlock()
+
+	return m.save()
 }
 
 func (m *Monitor) Start() (chan DirEvent, error) {
+	if m.awaitRoot() {
+		return m.Events(), nil
+	}
+
 	err := m.monitor.Start()
 	if err != nil {
 		return m.Events(), err
 	}
 
+	//the read loop of a previous run might still be closing its descriptors
+	if m.done != nil {
+		<-m.done
+	}
+
 	err = m.init()
 	if err != nil {
 		return nil, err
 	}
 
-	go func() {
-
-		var buf [syscall.SizeofInotifyEvent * 4096]byte
-		var move struct {
-			ID   uint32
-			Fd   int
-			From string
-			To   string
-		}
-
-		for {
-			epes := make([]syscall.EpollEvent, 1)
-			switch _, err := syscall.EpollWait(m.epfd, epes, -1); err {
-			case nil:
-				if epes[0].Fd == int32(m.ifd) {
-
-					//from inotify
-					n, err := syscall.Read(m.ifd, buf[:])
-					if n == 0 || m.stopped {
-						err := syscall.Close(m.ifd)
-						if err != nil {
-							m.errors <- os.NewSyscallError("Close", err)
-						}
+	//unmounts are reported for mount points, without the
+	//mount table we cannot tell which directories those are
+	m.mountpoints, err = readMounts(m.dir)
+	if err != nil {
+		m.mountpoints = map[string]string{}
+	}
 
-						return
-					} else if n < 0 {
-						m.errors <- os.NewSyscallError("Read", err)
-						continue
-					} else if n < syscall.SizeofInotifyEvent {
-						m.errors <- fmt.Errorf("inotify: short read")
-						continue
-					}
+	m.done = make(chan struct{})
+	m.quit = make(chan struct{})
+	if m.shared {
+		go m.dispatch()
+	} else {
+		go m.read()
+	}
 
-					var offset uint32
-					for offset <= uint32(n-syscall.SizeofInotifyEvent) {
-						raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
-						mask := uint32(raw.Mask)
-						nbytes := (*[syscall.PathMax]byte)(unsafe.Pointer(&buf[offset+syscall.SizeofInotifyEvent]))
-						name := strings.TrimRight(string(nbytes[0:raw.Len]), "\000")
-
-						m.Lock()
-						path := m.paths[int(raw.Wd)]
-						m.Unlock()
-						clean := filepath.Clean(path)
-
-						//send all but implicit/explicit watch removal and self events
-						if !m.stopped && mask&syscall.IN_IGNORED != syscall.IN_IGNORED &&
-							mask&syscall.IN_DELETE_SELF != syscall.IN_DELETE_SELF &&
-							mask&syscall.IN_MOVE_SELF != syscall.IN_MOVE_SELF {
-							m.unthrottled <- &mevent{clean}
-						}
+	//recursive watch
+	var st syscall.Stat_t
+	err = syscall.Stat(m.dir, &st)
+	if err != nil {
+		return m.Events(), os.NewSyscallError("Stat", err)
+	}
 
-						//root directory removed/renamed stop the monitor
-						if m.Dir() == clean {
-							//do a single event if the root dir is moved
-							if mask&syscall.IN_MOVE_SELF == syscall.IN_MOVE_SELF {
-								m.unthrottled <- &mevent{clean}
-							}
-
-							if mask&syscall.IN_DELETE_SELF == syscall.IN_DELETE_SELF ||
-								mask&syscall.IN_MOVE_SELF == syscall.IN_MOVE_SELF {
-								m.Stop()
-							}
-						}
+	m.dev = uint64(st.Dev)
+	m.fs = map[uint64]bool{}
+	m.seen = map[[2]uint64]string{}
+	if m.sparse != nil {
+		err = m.watchSparse()
+	} else {
+		err = m.watchTree(m.dir)
+	}
 
-						//something happend to a dir (created, deleted, moved etc)
-						//handle these cases consistently with other implementations
-						//to mimic recursive behaviour
-						if mask&syscall.IN_ISDIR == syscall.IN_ISDIR {
-							subject := filepath.Clean(filepath.Join(path, name))
-							if mask&syscall.IN_CREATE == syscall.IN_CREATE {
-								m.handleDirCreation(subject)
-							} else if mask&syscall.IN_MOVED_FROM == syscall.IN_MOVED_FROM {
-								move.ID = uint32(raw.Cookie)
-								move.From = subject
-
-								//attempt to fetch fd for directory that is about to be moved
-								m.Lock()
-								for fd, path := range m.paths {
-									if path == subject {
-										move.Fd = fd
-										//we remove it here since it might be moved outside
-										//the watchers view, if not the "IN_MOVE_TO" event will
-										//re-insert it into the m.paths
-										delete(m.paths, fd)
-									}
-								}
-								m.Unlock()
-
-							} else if mask&syscall.IN_MOVED_TO == syscall.IN_MOVED_TO {
-								if move.ID != 0 {
-									if move.ID == raw.Cookie {
-										move.To = subject
-										if move.Fd != 0 {
-											//it is associated with a fd in our path index, modify it
-											//to complete the move for further events
-											m.Lock()
-											m.paths[move.Fd] = subject
-											m.Unlock()
-										}
-									} else {
-										m.errors <- fmt.Errorf("move didn't have a matching Cookie on arrival of IN_MOVE_FROM event")
-									}
-								} else {
-									m.errors <- fmt.Errorf("move has no Cookie on arrival of IN_MOVE_FROM event")
-								}
-							} else if mask&syscall.IN_DELETE == syscall.IN_DELETE {
-								//dir was removed, remove from paths index
-								//if its indexed
-								m.Lock()
-								for fd, path := range m.paths {
-									if path == subject {
-										delete(m.paths, fd)
-									}
-								}
-								m.Unlock()
-							}
-						}
+	if err != nil {
+		return m.Events(), err
+	}
 
-						offset += syscall.SizeofInotifyEvent + raw.Len
-					}
+	//the whole tree might be polled
+	if m.poller == nil || !m.poller.has(m.Dir()) {
+		err = m.addWatch(m.Dir())
+		if err != nil {
+			return m.Events(), err
+		}
+	}
 
-				} else if epes[0].Fd == int32(m.pipefd[0]) {
+	m.replay()
+	return m.Events(), nil
+}
 
-					//we are shutting down
-					err := m.close()
+//reads the events of the own inotify instance until the monitor stops
+func (m *Monitor) read() {
+	defer close(m.done)
+
+	var buf [syscall.SizeofInotifyEvent * 4096]byte
+	var mv move
+	for {
+		epes := make([]syscall.EpollEvent, 1)
+		switch _, err := syscall.EpollWait(m.epfd, epes, -1); err {
+		case nil:
+			if epes[0].Fd == int32(m.ifd) {
+
+				//from inotify
+				n, err := syscall.Read(m.ifd, buf[:])
+				if n == 0 || m.stopped {
+					err := syscall.Close(m.ifd)
 					if err != nil {
-						m.errors <- fmt.Errorf("Failed to close down: %s", err)
+						m.fail(os.NewSyscallError("Close", err))
 					}
 
 					return
-				} else {
-					m.errors <- fmt.Errorf("epoll wait: unexpected event source: '%d'", epes[0].Fd)
+				} else if n < 0 {
+					m.fail(os.NewSyscallError("Read", err))
+					continue
+				} else if n < syscall.SizeofInotifyEvent {
+					m.fail(fmt.Errorf("inotify: short read"))
+					continue
+				}
+
+				for _, ev := range parseEvents(buf[:n]) {
+					m.handle(ev, &mv)
 				}
-			case syscall.EINTR:
-				continue
-			default:
-				m.errors <- fmt.Errorf("epoll wait: %s", err)
-			}
 
+			} else if epes[0].Fd == int32(m.pipefd[0]) {
+
+				//we are shutting down
+				err := m.close()
+				if err != nil {
+					m.fail(fmt.Errorf("Failed to close down: %s", err))
+				}
+
+				return
+			} else if m.mfd >= 0 && epes[0].Fd == int32(m.mfd) {
+
+				//from the mount table
+				m.handleMountChange()
+			} else {
+				m.fail(fmt.Errorf("epoll wait: unexpected event source: '%d'", epes[0].Fd))
+			}
+		case syscall.EINTR:
+			continue
+		default:
+			m.fail(fmt.Errorf("epoll wait: %s", err))
 		}
-	}()
 
-	//recursive watch
-	err = filepath.Walk(m.dir, func(path string, fi os.FileInfo, err error) error {
-		if err != nil {
-			return err
+	}
+}
+
+//a directory that was moved away, until it arrives elsewhere in the tree
+type move struct {
+	ID   uint32
+	Fd   int
+	From string
+	To   string
+}
+
+//handles an event for every path under which its directory is watched
+func (m *Monitor) handle(ev inotifyEvent, mv *move) {
+	mask := ev.mask
+	name := ev.name
+
+	//the same directory can be visible under several paths (bind mounts),
+	//the event is handled for each of them
+	m.Lock()
+	paths := append([]string{}, m.paths[ev.wd]...)
+	m.Unlock()
+
+	for _, path := range paths {
+		clean := filepath.Clean(path)
+		incomplete := m.isIncomplete(mask, clean, name)
+
+		//send all but implicit/explicit watch removal and self events, listing
+		//the watched directory itself (which we do as well) is not an access.
+		//Opens are watched in write completion mode but are not always observed
+		if !m.stopped && mask&syscall.IN_IGNORED != syscall.IN_IGNORED &&
+			!(name == "" && mask&(syscall.IN_ACCESS|syscall.IN_OPEN) != 0) &&
+			!(mask&syscall.IN_OPEN != 0 && m.ops&Access == 0) &&
+			mask&syscall.IN_UNMOUNT != syscall.IN_UNMOUNT &&
+			mask&syscall.IN_DELETE_SELF != syscall.IN_DELETE_SELF &&
+			mask&syscall.IN_MOVE_SELF != syscall.IN_MOVE_SELF &&
+			!incomplete {
+			m.emit(&mevent{clean, name, opOf(mask)})
 		}
 
-		if fi.IsDir() {
-			err = m.addWatch(path)
-			if err != nil {
-				return fmt.Errorf("Failed to add '%s': %s", path, err)
+		//root directory removed/renamed stop the monitor
+		if m.Dir() == clean && !m.stopped {
+			if mask&syscall.IN_DELETE_SELF == syscall.IN_DELETE_SELF {
+				m.gone(RootRemoved)
+			} else if mask&syscall.IN_MOVE_SELF == syscall.IN_MOVE_SELF {
+				m.gone(RootRenamed)
 			}
 		}
 
-		return nil
-	})
+		//the file system of the directory is gone, and so is its watch
+		if mask&syscall.IN_UNMOUNT == syscall.IN_UNMOUNT {
+			m.handleUnmount(clean)
+		}
 
-	if err != nil {
-		return m.Events(), err
-	}
+		//something happend to a dir (created, deleted, moved etc)
+		//handle these cases consistently with other implementations
+		//to mimic recursive behaviour
+		if mask&syscall.IN_ISDIR == syscall.IN_ISDIR {
+			subject := filepath.Clean(filepath.Join(path, name))
+			if mask&syscall.IN_CREATE == syscall.IN_CREATE {
+				m.handleDirCreation(subject)
+			} else if mask&syscall.IN_MOVED_FROM == syscall.IN_MOVED_FROM {
+				mv.ID = ev.cookie
+				mv.From = subject
+
+				//attempt to fetch fd for directory that is about to be moved
+				//we remove it here since it might be moved outside
+				//the watchers view, if not the "IN_MOVE_TO" event will
+				//re-insert it into the m.paths
+				m.Lock()
+				mv.Fd = m.removePath(subject)
+				m.Unlock()
+
+			} else if mask&syscall.IN_MOVED_TO == syscall.IN_MOVED_TO {
+				if mv.ID != 0 {
+					if mv.ID == ev.cookie {
+						mv.To = subject
+						if mv.Fd != 0 {
+							//it is associated with a fd in our path index, modify it
+							//to complete the move for further events
+							m.Lock()
+							m.addPath(mv.Fd, subject)
+							m.Unlock()
+						}
+					} else {
+						m.fail(fmt.Errorf("move didn't have a matching Cookie on arrival of IN_MOVE_FROM event"))
+					}
+				} else {
+					m.fail(fmt.Errorf("move has no Cookie on arrival of IN_MOVE_FROM event"))
+				}
+			} else if mask&syscall.IN_DELETE == syscall.IN_DELETE {
+				//dir was removed, remove from paths index
+				//if its indexed
+				m.Lock()
+				m.removePath(subject)
+				m.Unlock()
+			}
+		}
 
-	return m.Events(), m.addWatch(m.Dir())
+		//when following symlinks, links to directories are watched
+		//when they are created and no longer when they are removed
+		if m.follow && mask&syscall.IN_ISDIR != syscall.IN_ISDIR {
+			subject := filepath.Clean(filepath.Join(path, name))
+			if mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+				if fi, err := os.Stat(subject); err == nil && fi.IsDir() {
+					m.handleDirCreation(subject)
+				}
+			} else if mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0 {
+				m.unwatch(subject)
+			}
+		}
+	}
 }
@@ -0,0 +1,325 @@
+// +build linux
+
+package monitor
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestAliasedFolderEmitsForEach(t *testing.T) {
+	m := setupTestDirMonitor(t, Recursive, WithMountWatch())
+	dir := filepath.Join(m.Dir(), "existing_dir")
+	alias := doCreateFolders(t, m, "alias_dir")
+	doBindMount(t, dir, alias)
+	defer syscall.Unmount(alias, syscall.MNT_DETACH)
+
+	//inotify returns the descriptor of the existing watch for the alias
+	done := waitForNEvents(t, m, 2, 2)
+	m.Start()
+
+	doWriteFile(t, m, "#foobar", "existing_dir", "file_1.md")
+
+	res := <-done
+	assertNoErrors(t, res.errs)
+	if len(res.evs) != 2 || res.evs[0].Dir() == res.evs[1].Dir() ||
+		(res.evs[0].Dir() != dir && res.evs[0].Dir() != alias) ||
+		(res.evs[1].Dir() != dir && res.evs[1].Dir() != alias) {
+		t.Fatalf("Expected an event for both '%s' and '%s', got: %v", dir, alias, res.evs)
+	}
+
+	//unmounting the alias keeps the original, the mount event is
+	//only read once the unmount returned as that takes a while
+	err := syscall.Unmount(alias, 0)
+	if err != nil {
+		t.Fatalf("Failed to unmount '%s': %s", alias, err)
+	}
+
+	done = waitForNEvents(t, m, 1, 1)
+	res = <-done
+	assertNoErrors(t, res.errs)
+	assertMountEvent(t, res.evs[0], alias, false)
+
+	done = waitForNEvents(t, m, 1, 1)
+	doSettle()
+	doWriteFile(t, m, "#foobar", "existing_dir", "file_2.md")
+
+	res = <-done
+	assertNoErrors(t, res.errs)
+	assertNthDirEvent(t, res.evs, 1, dir)
+	assertCanEmit(t, m, dir, true)
+	assertShutdown(t, m)
+}
+
+func TestUnreliableFilesystemPolled(t *testing.T) {
+	m := setupTestDirMonitor(t, Recursive, WithPollFallback(Latency))
+
+	//pretend the file system of the test directory doesn't notify
+	var sfs syscall.Statfs_t
+	err := syscall.Statfs(m.Dir(), &sfs)
+	if err != nil {
+		t.Fatalf("Failed to statfs: %s", err)
+	}
+
+	typ := uint32(sfs.Type)
+	name, existed := unreliableFS[typ]
+	unreliableFS[typ] = "test"
+	defer func() {
+		delete(unreliableFS, typ)
+		if existed {
+			unreliableFS[typ] = name
+		}
+	}()
+
+	done := waitForNEvents(t, m, 1, 1)
+	_, err = m.Start()
+	if err != nil {
+		t.Fatalf("Failed to start: %s", err)
+	}
+
+	assertCanEmit(t, m, m.Dir(), true)
+	if len(m.(*Monitor).paths) != 0 {
+		t.Fatalf("Expected no inotify watches for a polled tree, got: %v", m.(*Monitor).paths)
+	}
+
+	doWriteFile(t, m, "#foobar", "existing_dir", "file_1.md")
+
+	res := <-done
+	assertNoErrors(t, res.errs)
+	assertNthDirEvent(t, res.evs, 1, filepath.Join(m.Dir(), "existing_dir"))
+	assertShutdown(t, m)
+}
+
+//mounts an empty file system over the directory, if allowed
+func doMount(t *testing.T, dir string) {
+	err := syscall.Mount("none", dir, "tmpfs", 0, "")
+	if err == syscall.EPERM {
+		t.Skipf("Not allowed to mount in this environment")
+	} else if err != nil {
+		t.Fatalf("Failed to mount '%s': %s", dir, err)
+	}
+}
+
+//makes the directory visible at another path as well, if allowed
+func doBindMount(t *testing.T, dir, alias string) {
+	err := syscall.Mount(dir, alias, "", syscall.MS_BIND, "")
+	if err == syscall.EPERM {
+		t.Skipf("Not allowed to mount in this environment")
+	} else if err != nil {
+		t.Fatalf("Failed to bind mount '%s' at '%s': %s", dir, alias, err)
+	}
+}
+
+func assertMountEvent(t *testing.T, ev DirEvent, dir string, mounted bool) {
+	mev, ok := ev.(MountEvent)
+	if !ok || mev.Dir() != dir || mev.Mounted() != mounted {
+		t.Fatalf("Expected mount event (mounted: %v) for '%s', got: %#v", mounted, dir, ev)
+	}
+}
+
+func TestSubFolderUnmount(t *testing.T) {
+	m := setupTestDirMonitor(t, Recursive)
+	dir := filepath.Join(m.Dir(), "existing_dir")
+	doMount(t, dir)
+	defer syscall.Unmount(dir, syscall.MNT_DETACH)
+
+	done := waitForNEvents(t, m, 1, 1)
+	m.Start()
+
+	err := syscall.Unmount(dir, 0)
+	if err != nil {
+		t.Fatalf("Failed to unmount '%s': %s", dir, err)
+	}
+
+	res := <-done
+	assertNoErrors(t, res.errs)
+	assertMountEvent(t, res.evs[0], dir, false)
+
+	//the directory that was covered is watched instead
+	done = waitForNEvents(t, m, 1, 1)
+	doWriteFile(t, m, "#foobar", "existing_dir", "file_1.md")
+
+	res = <-done
+	assertNoErrors(t, res.errs)
+	assertNthDirEvent(t, res.evs, 1, dir)
+	assertShutdown(t, m)
+}
+
+func TestSubFolderMountWatched(t *testing.T) {
+	m := setupTestDirMonitor(t, Recursive, WithMountWatch())
+
+	dir := filepath.Join(m.Dir(), "existing_dir")
+	done := waitForNEvents(t, m, 1, 1)
+	m.Start()
+
+	doMount(t, dir)
+	defer syscall.Unmount(dir, syscall.MNT_DETACH)
+
+	res := <-done
+	assertNoErrors(t, res.errs)
+	assertMountEvent(t, res.evs[0], dir, true)
+
+	//the new file system is watched
+	done = waitForNEvents(t, m, 1, 1)
+	doWriteFile(t, m, "#foobar", "existing_dir", "file_1.md")
+
+	res = <-done
+	assertNoErrors(t, res.errs)
+	assertNthDirEvent(t, res.evs, 1, dir)
+	assertShutdown(t, m)
+}
+
+func TestWalkSelectedLikeWatches(t *testing.T) {
+	m := setupTestDirMonitor(t, Recursive, WithSameFilesystem(), WithFollowSymlinks())
+
+	mounted := filepath.Join(m.Dir(), "existing_dir")
+	doMount(t, mounted)
+	defer syscall.Unmount(mounted, syscall.MNT_DETACH)
+
+	target := doCreateFolders(t, m, "..", "outside_dir")
+	link := filepath.Join(m.Dir(), "linked_dir")
+	err := os.Symlink(target, link)
+	if err != nil {
+		t.Fatalf("Failed to create symlink: %s", err)
+	}
+
+	//state and verification see the tree as the watches do
+	walked := map[string]bool{}
+	err = m.(based).base().walkSelected(m.Dir(), func(dir string) error {
+		walked[dir] = true
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("Failed to walk: %s", err)
+	}
+
+	if !walked[m.Dir()] || !walked[link] || walked[mounted] {
+		t.Fatalf("Expected the link '%s' to be walked and the mount point '%s' not, got: %v", link, mounted, walked)
+	}
+}
+
+func TestVerifyCatchesDroppedEvents(t *testing.T) {
+	m := setupTestDirMonitor(t, Recursive, WithVerify(Latency, false))
+
+	done := waitForNEvents(t, m, 1, 1)
+	m.Start()
+
+	//pretend the kernel drops the events of a directory
+	dir := filepath.Join(m.Dir(), "existing_dir")
+	lm := m.(*Monitor)
+	lm.Lock()
+	for fd, paths := range lm.paths {
+		if paths[0] == dir {
+			syscall.InotifyRmWatch(lm.ifd, uint32(fd))
+		}
+	}
+	lm.Unlock()
+
+	doSettle()
+	doWriteFile(t, m, "#foobar", "existing_dir", "file_1.md")
+
+	res := <-done
+	assertNoErrors(t, res.errs)
+	assertNthDirEvent(t, res.evs, 1, dir)
+	if m.Discrepancies() != 1 {
+		t.Fatalf("Expected 1 discrepancy, got: %d", m.Discrepancies())
+	}
+
+	assertShutdown(t, m)
+}
+
+func TestSharedInotify(t *testing.T) {
+	m := setupTestDirMonitor(t, Recursive, WithShared())
+	dir := filepath.Join(m.Dir(), "existing_dir")
+	sub, err := NewWithOptions(dir, WithLatency(Latency), WithShared())
+	if err != nil {
+		t.Fatalf("Failed to create monitor: %s", err)
+	}
+
+	for _, mon := range []M{m, sub} {
+		_, err = mon.Start()
+		if err != nil {
+			t.Fatalf("Failed to start: %s", err)
+		}
+	}
+
+	//one watch per directory, the overlapping ones are used by both
+	inotify.Lock()
+	nwatches, nmonitors := len(inotify.watches), len(inotify.monitors)
+	inotify.Unlock()
+	if nwatches != 3 || nmonitors != 2 {
+		t.Fatalf("Expected 3 watches for 2 monitors, got %d watches for %d", nwatches, nmonitors)
+	}
+
+	done := waitForNEvents(t, m, 1, 1)
+	subdone := waitForNEvents(t, sub, 1, 1)
+	doWriteFile(t, m, "#foobar", "existing_dir", "file_1.md")
+
+	res := <-done
+	assertNoErrors(t, res.errs)
+	assertNthDirEvent(t, res.evs, 1, dir)
+	res = <-subdone
+	assertNoErrors(t, res.errs)
+	assertNthDirEvent(t, res.evs, 1, dir)
+
+	//the other keeps the watches it shared
+	err = sub.Stop()
+	if err != nil {
+		t.Fatalf("Failed to stop: %s", err)
+	}
+
+	done = waitForNEvents(t, m, 1, 1)
+	doWriteFile(t, m, "#foobar", "existing_dir", "existing_sub_dir", "file_2.md")
+
+	res = <-done
+	assertNoErrors(t, res.errs)
+	assertNthDirEvent(t, res.evs, 1, filepath.Join(dir, "existing_sub_dir"))
+
+	assertShutdown(t, m)
+	inotify.Lock()
+	nmonitors = len(inotify.monitors)
+	inotify.Unlock()
+	if nmonitors != 0 {
+		t.Fatalf("Expected the shared instance to be closed, still used by %d monitors", nmonitors)
+	}
+}
+
+func TestWriteCompletionHardLink(t *testing.T) {
+	m := setupTestDirMonitor(t, Recursive, WithWriteCompletion(2))
+
+	done := waitForNEvents(t, m, 1, 1)
+	m.Start()
+
+	//a hard link is never closed after writing
+	err := os.Link(filepath.Join(m.Dir(), "existing_file_1.md"), filepath.Join(m.Dir(), "existing_dir", "link_1.md"))
+	if err != nil {
+		t.Fatalf("Failed to create hard link: %s", err)
+	}
+
+	res := <-done
+	assertNoErrors(t, res.errs)
+	assertNthDirEvent(t, res.evs, 1, filepath.Join(m.Dir(), "existing_dir"))
+	assertShutdown(t, m)
+}
+
+func TestAccessIncludesOwnReads(t *testing.T) {
+	m := setupTestDirMonitor(t, Recursive, WithOps(DefaultOps | Access))
+
+	//the monitor lists the tree to watch it, nothing else reads it
+	done := waitForNEvents(t, m, 1, 1)
+	m.Start()
+
+	res := <-done
+	assertNoErrors(t, res.errs)
+	assertNthDirEvent(t, res.evs, 1, m.Dir())
+	if oev, ok := res.evs[0].(OpEvent); !ok || oev.Op() != Access {
+		t.Fatalf("Expected event to be about an access, got: %v", res.evs[0])
+	}
+
+	//more of them might be on their way
+	halt(m)
+	assertShutdown(t, m)
+}
@@ -1,8 +1,10 @@
 package monitor
 
 import (
+	"context"
 	"os"
 	"path/filepath"
+	"runtime"
 	"testing"
 	"time"
 )
@@ -58,6 +60,29 @@ func TestRootFileCreationTwiceWithSettle(t *testing.T) {
 	assertShutdown(t, m)
 }
 
+func TestRootFileCreationFlush(t *testing.T) {
+	m := setupTestDirMonitor(t, Recursive)
+	done := waitForNEvents(t, m, 1, 1)
+	m.Start()
+
+	doWriteFile(t, m, "#foobar", "file_1.md")
+	doFlush(t, m)
+
+	res := <-done
+	assertNoErrors(t, res.errs)
+	assertNthDirEvent(t, res.evs, 1, m.Dir())
+	assertShutdown(t, m)
+}
+
+func TestFlushStopped(t *testing.T) {
+	m := setupTestDirMonitor(t, Recursive)
+
+	err := m.Flush(context.Background())
+	if err != ErrAlreadyStopped {
+		t.Fatalf("Expected flush of stopped monitor to fail with '%s', got: %v", ErrAlreadyStopped, err)
+	}
+}
+
 func TestRootFileRemoval(t *testing.T) {
 	m := setupTestDirMonitor(t, Recursive)
 	done := waitForNEvents(t, m, 1, 1)
@@ -141,6 +166,199 @@ func TestRootFileEditTwiceWithSameContent(t *testing.T) {
 	assertShutdown(t, m)
 }
 
+func TestRootFileEditTwiceWithSameContentFiltered(t *testing.T) {
+	m := setupTestDirMonitor(t, Recursive, WithContentFilter(Recursive, 1024))
+
+	done := waitForNEvents(t, m, 2, 2)
+	m.Start()
+
+	doWriteFile(t, m, "#foobar", "existing_file_1.md")
+	doSettle()
+	doWriteFile(t, m, "#foobar", "existing_file_1.md")
+
+	res := <-done
+	assertTimeout(t, res.errs)
+	assertNthDirEvent(t, res.evs, 1, m.Dir())
+	assertShutdown(t, m)
+}
+
+func TestRootFileEditorTempFiltered(t *testing.T) {
+	m := setupTestDirMonitor(t, Recursive, WithEditorFilter())
+
+	done := waitForNEvents(t, m, 1, 1)
+	m.Start()
+
+	doWriteFile(t, m, "#foobar", "existing_file_1.md~")
+	doWriteFile(t, m, "#foobar", ".existing_file_1.md.swp")
+	doRemove(t, m, ".existing_file_1.md.swp")
+
+	res := <-done
+	assertTimeout(t, res.errs)
+	assertShutdown(t, m)
+}
+
+func TestRootFileEditorAtomicSave(t *testing.T) {
+	m := setupTestDirMonitor(t, Recursive, WithEditorFilter())
+
+	done := waitForNEvents(t, m, 1, 2)
+	m.Start()
+
+	doWriteFile(t, m, "#foobar", "existing_file_1.md___jb_tmp___")
+	doSettle()
+	doMove(t, m, "existing_file_1.md___jb_tmp___", "->", "existing_file_1.md")
+
+	res := <-done
+	assertNoErrors(t, res.errs)
+	if len(res.evs) != 1 {
+		t.Fatalf("Expected a single event for the atomic save, got: %d", len(res.evs))
+	}
+
+	assertNthDirEvent(t, res.evs, 1, m.Dir())
+	assertShutdown(t, m)
+}
+
+func TestEditorTempNames(t *testing.T) {
+	for name, expected := range map[string]bool{
+		"main.go":              false,
+		"main.go~":             true,
+		".main.go.swp":         true,
+		".#main.go":            true,
+		"#main.go#":            true,
+		"#":                    false,
+		"main.go___jb_tmp___":  true,
+		"main.go___jb_old___":  true,
+		"4913":                 true,
+		"main.go.kate-swp":     true,
+		".goutputstream-X1Y2Z": true,
+	} {
+		if isEditorTemp(name) != expected {
+			t.Fatalf("Expected '%s' to be an editor temp file: %t", name, expected)
+		}
+	}
+}
+
+//only inotify knows when a file is closed, others
+//would consider the file complete when it stopped growing
+func TestRootFileWriteCompletion(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Write completion of files that are kept open can only be detected on linux")
+	}
+
+	m := setupTestDirMonitor(t, Recursive, WithWriteCompletion(2))
+
+	done := waitForNEvents(t, m, 1, 1)
+	m.Start()
+
+	f, err := os.Create(filepath.Join(m.Dir(), "file_1.md"))
+	if err != nil {
+		t.Fatalf("Failed to create file: %s", err)
+	}
+
+	defer f.Close()
+	_, err = f.WriteString("#foo")
+	if err != nil {
+		t.Fatalf("Failed to write file: %s", err)
+	}
+
+	res := <-done
+	assertTimeout(t, res.errs)
+
+	done = waitForNEvents(t, m, 1, 1)
+	_, err = f.WriteString("bar")
+	if err != nil {
+		t.Fatalf("Failed to write file: %s", err)
+	}
+
+	f.Close()
+
+	res = <-done
+	assertNoErrors(t, res.errs)
+	assertNthDirEvent(t, res.evs, 1, m.Dir())
+	assertShutdown(t, m)
+}
+
+func TestRootFileWriteCompletionStable(t *testing.T) {
+	m := setupTestDirMonitor(t, Recursive, WithWriteCompletion(2))
+
+	//pretend the backend doesn't know when files are closed
+	m.(*Monitor).closes = false
+	done := waitForNEvents(t, m, 1, 2)
+	m.Start()
+
+	doWriteFile(t, m, "#foo", "file_1.md")
+	doWriteFile(t, m, "#foobar", "file_1.md")
+
+	res := <-done
+	assertNoErrors(t, res.errs)
+	if len(res.evs) != 1 {
+		t.Fatalf("Expected a single event once the directory is stable, got: %d", len(res.evs))
+	}
+
+	assertNthDirEvent(t, res.evs, 1, m.Dir())
+	assertShutdown(t, m)
+}
+
+func TestWriteCompletionStableReplacedDir(t *testing.T) {
+	m := setupTestDirMonitor(t, Recursive, WithWriteCompletion(50))
+
+	m.(*Monitor).closes = false
+	done := waitForNEvents(t, m, 1, 1)
+	m.Start()
+
+	//a directory that can no longer be listed will not become stable
+	sub := filepath.Join(m.Dir(), "existing_dir", "existing_sub_dir")
+	doWriteFile(t, m, "#foo", "existing_dir", "existing_sub_dir", "file_1.md")
+	doSettle()
+	doRemove(t, m, "existing_dir", "existing_sub_dir")
+	doWriteFile(t, m, "#foo", "existing_dir", "existing_sub_dir")
+
+	res := <-done
+	assertNoErrors(t, res.errs)
+	if len(res.evs) != 1 || res.evs[0].Dir() != sub {
+		t.Fatalf("Expected an event for '%s' right away, got: %v", sub, res.evs)
+	}
+
+	assertShutdown(t, m)
+}
+
+func TestRootFileChmodAttrib(t *testing.T) {
+	m := setupTestDirMonitor(t, Recursive, WithOps(DefaultOps | Attrib))
+
+	done := waitForNEvents(t, m, 1, 1)
+	m.Start()
+
+	err := os.Chmod(filepath.Join(m.Dir(), "existing_file_1.md"), 0755)
+	if err != nil {
+		t.Fatalf("Failed to chmod: %s", err)
+	}
+
+	res := <-done
+	assertNoErrors(t, res.errs)
+	assertNthDirEvent(t, res.evs, 1, m.Dir())
+	if oev, ok := res.evs[0].(OpEvent); ok && oev.Op()&Attrib == 0 {
+		t.Fatalf("Expected event to be about an attribute change, got: %s", oev.Op())
+	}
+
+	assertShutdown(t, m)
+}
+
+func TestRootFileCreationOnlyRemovals(t *testing.T) {
+	if runtime.GOOS == "darwin" {
+		t.Skip("FSEvents doesn't tell what kind of change happened in a directory")
+	}
+
+	m := setupTestDirMonitor(t, Recursive, WithOps(Remove))
+
+	done := waitForNEvents(t, m, 1, 1)
+	m.Start()
+
+	doWriteFile(t, m, "#foobar", "file_1.md")
+
+	res := <-done
+	assertTimeout(t, res.errs)
+	assertShutdown(t, m)
+}
+
 func TestRootFileMove(t *testing.T) {
 	m := setupTestDirMonitor(t, Recursive)
 	done := waitForNEvents(t, m, 1, 1)
@@ -357,6 +575,75 @@ func TestSubFolderCreationRecursive(t *testing.T) {
 	assertShutdown(t, m)
 }
 
+func TestSymlinkedFolderFollowed(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Following symlinks is only supported on linux")
+	}
+
+	m := setupTestDirMonitor(t, Recursive, WithFollowSymlinks())
+
+	target := doCreateFolders(t, m, "..", "outside_dir")
+	link := filepath.Join(m.Dir(), "linked_dir")
+	err := os.Symlink(target, link)
+	if err != nil {
+		t.Fatalf("Failed to create symlink: %s", err)
+	}
+
+	//a cycle back to the root
+	err = os.Symlink(m.Dir(), filepath.Join(m.Dir(), "existing_dir", "loop"))
+	if err != nil {
+		t.Fatalf("Failed to create symlink: %s", err)
+	}
+
+	done := waitForNEvents(t, m, 1, 1)
+	_, err = m.Start()
+	if err != nil {
+		t.Fatalf("Failed to start: %s", err)
+	}
+
+	doWriteFile(t, m, "#foobar", "..", "outside_dir", "file_1.md")
+
+	res := <-done
+	assertNoErrors(t, res.errs)
+	if len(res.evs) != 1 || res.evs[0].Dir() != link {
+		t.Fatalf("Expected an event for the link '%s', got: %v", link, res.evs)
+	}
+
+	assertShutdown(t, m)
+}
+
+func TestSymlinkedFolderInTreeRemoved(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Following symlinks is only supported on linux")
+	}
+
+	m := setupTestDirMonitor(t, Recursive, WithFollowSymlinks())
+
+	//the link is walked before the directory it links to
+	target := doCreateFolders(t, m, "z_real")
+	err := os.Symlink(target, filepath.Join(m.Dir(), "a_link"))
+	if err != nil {
+		t.Fatalf("Failed to create symlink: %s", err)
+	}
+
+	done := waitForNEvents(t, m, 2, 2)
+	_, err = m.Start()
+	if err != nil {
+		t.Fatalf("Failed to start: %s", err)
+	}
+
+	doRemove(t, m, "a_link")
+	doSettle()
+	doWriteFile(t, m, "#foobar", "z_real", "file_1.md")
+
+	res := <-done
+	assertNoErrors(t, res.errs)
+	assertNthDirEvent(t, res.evs, 1, m.Dir())
+	assertNthDirEvent(t, res.evs, 2, target)
+	assertCanEmit(t, m, target, true)
+	assertShutdown(t, m)
+}
+
 func TestWatchedFolderRemoval(t *testing.T) {
 	m := setupTestDirMonitor(t, Recursive)
 	done := waitForNEvents(t, m, 1, 4)
@@ -390,6 +677,60 @@ func TestWatchedFolderRename(t *testing.T) {
 	assertShutdown(t, m)
 }
 
+func TestWatchedFolderRemovalReported(t *testing.T) {
+	m := setupTestDirMonitor(t, Recursive)
+	m.Start()
+
+	doRemove(t, m, "..", "workspace")
+	assertRootEvent(t, m, RootRemoved)
+	assertCanEmit(t, m, m.Dir(), false)
+	assertShutdown(t, m)
+}
+
+func TestWatchedFolderRemovalPersistent(t *testing.T) {
+	m := setupTestDirMonitor(t, Recursive, WithPersistentRoot())
+
+	m.Start()
+
+	doRemove(t, m, "..", "workspace")
+	assertRootEvent(t, m, RootRemoved)
+	assertCanEmit(t, m, m.Dir(), false)
+
+	//the same path comes back, as after a clean build
+	doCreateFolders(t, m)
+	assertRootEvent(t, m, RootCreated)
+
+	done := waitForNEvents(t, m, 1, 1)
+	doWriteFile(t, m, "#foobar", "file_1.md")
+
+	res := <-done
+	assertNoErrors(t, res.errs)
+	assertNthDirEvent(t, res.evs, 1, m.Dir())
+	assertShutdown(t, m)
+}
+
+func TestWatchedFolderRemovalPersistentStopped(t *testing.T) {
+	m := setupTestDirMonitor(t, Recursive, WithPersistentRoot())
+
+	m.Start()
+
+	doRemove(t, m, "..", "workspace")
+	assertRootEvent(t, m, RootRemoved)
+
+	//stopping while waiting means it no longer comes back
+	err := m.Stop()
+	if err != nil {
+		t.Fatalf("Failed to stop while waiting for the root: %s", err)
+	}
+
+	done := waitForNEvents(t, m, 1, 1)
+	doCreateFolders(t, m)
+
+	res := <-done
+	assertTimeout(t, res.errs)
+	assertShutdown(t, m)
+}
+
 func TestSubFolderCreationStartStop(t *testing.T) {
 	m := setupTestDirMonitor(t, Recursive)
 
@@ -430,6 +771,673 @@ func TestSubFolderCreationStartStop(t *testing.T) {
 	assertShutdown(t, m)
 }
 
+func TestPauseResume(t *testing.T) {
+	m := setupTestDirMonitor(t, Recursive)
+
+	//nothing comes in while paused
+	done := waitForNEvents(t, m, 1, 1)
+	m.Start()
+
+	err := m.Pause()
+	if err != nil {
+		t.Fatalf("Failed to pause: %s", err)
+	}
+
+	doWriteFile(t, m, "#foobar", "file_1.md")
+	doWriteFile(t, m, "#foobar", "existing_dir", "file_1.md")
+	doWriteFile(t, m, "#foobar", "existing_dir", "file_2.md")
+
+	res := <-done
+	assertTimeout(t, res.errs)
+
+	//a single event per changed directory on resume
+	done = waitForNEvents(t, m, 2, 3)
+	err = m.Resume(false)
+	if err != nil {
+		t.Fatalf("Failed to resume: %s", err)
+	}
+
+	res = <-done
+	assertNoErrors(t, res.errs)
+	assertAtLeast(t, res.evs, 1, m.Dir())
+	assertAtLeast(t, res.evs, 1, filepath.Join(m.Dir(), "existing_dir"))
+	assertShutdown(t, m)
+}
+
+func TestPauseResumeDiscard(t *testing.T) {
+	m := setupTestDirMonitor(t, Recursive)
+	done := waitForNEvents(t, m, 1, 1)
+	m.Start()
+
+	err := m.Pause()
+	if err != nil {
+		t.Fatalf("Failed to pause: %s", err)
+	}
+
+	err = m.Pause()
+	if err != ErrAlreadyPaused {
+		t.Fatalf("Expected second pause to fail with '%s', got: %v", ErrAlreadyPaused, err)
+	}
+
+	doWriteFile(t, m, "#foobar", "file_1.md")
+	doSettle()
+
+	err = m.Resume(true)
+	if err != nil {
+		t.Fatalf("Failed to resume: %s", err)
+	}
+
+	res := <-done
+	assertTimeout(t, res.errs)
+
+	err = m.Resume(false)
+	if err != ErrNotPaused {
+		t.Fatalf("Expected resume of running monitor to fail with '%s', got: %v", ErrNotPaused, err)
+	}
+
+	assertShutdown(t, m)
+}
+
+func TestSuppress(t *testing.T) {
+	m := setupTestDirMonitor(t, Recursive)
+	done := waitForNEvents(t, m, 1, 1)
+	m.Start()
+
+	dir := filepath.Join(m.Dir(), "existing_dir")
+	err := m.Suppress([]string{dir}, func() error {
+		doWriteFile(t, m, "#foobar", "existing_dir", "file_1.md")
+		doWriteFile(t, m, "#foobar", "existing_dir", "file_2.md")
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("Failed to suppress: %s", err)
+	}
+
+	res := <-done
+	assertTimeout(t, res.errs)
+	assertShutdown(t, m)
+}
+
+func TestSuppressLinkedRoot(t *testing.T) {
+	link := setupLinkedTestDir(t)
+	m, err := NewWithOptions(link, WithLatency(Latency))
+	if err != nil {
+		t.Fatalf("Failed to create monitor: %s", err)
+	}
+
+	done := waitForNEvents(t, m, 1, 1)
+	m.Start()
+
+	//the path goes through the link, the events don't
+	err = m.Suppress([]string{filepath.Join(link, "existing_dir")}, func() error {
+		doWriteFile(t, m, "#foobar", "existing_dir", "file_1.md")
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("Failed to suppress: %s", err)
+	}
+
+	res := <-done
+	assertTimeout(t, res.errs)
+	assertShutdown(t, m)
+}
+
+func TestSuppressLetsOthersThrough(t *testing.T) {
+	m := setupTestDirMonitor(t, Recursive)
+	done := waitForNEvents(t, m, 1, 1)
+	m.Start()
+
+	path := filepath.Join(m.Dir(), "existing_file_1.md")
+	err := m.Suppress([]string{path}, func() error {
+		doWriteFile(t, m, "#foobar", "existing_file_1.md")
+		doWriteFile(t, m, "#foobar", "existing_dir", "file_1.md")
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("Failed to suppress: %s", err)
+	}
+
+	res := <-done
+	assertNoErrors(t, res.errs)
+	assertNthDirEvent(t, res.evs, 1, filepath.Join(m.Dir(), "existing_dir"))
+	assertShutdown(t, m)
+}
+
+func TestStorm(t *testing.T) {
+	m := setupTestDirMonitor(t, Recursive, WithStorm(1, Latency*2))
+
+	done := waitForNEvents(t, m, 2, 2)
+	m.Start()
+
+	doWriteFile(t, m, "#foobar", "file_1.md")
+	doWriteFile(t, m, "#foobar", "existing_dir", "file_1.md")
+	doWriteFile(t, m, "#foobar", "existing_dir", "existing_sub_dir", "file_1.md")
+
+	res := <-done
+	assertNoErrors(t, res.errs)
+	assertNthDirEvent(t, res.evs, 1, m.Dir())
+	assertNthDirEvent(t, res.evs, 2, m.Dir())
+
+	sev, ok := res.evs[1].(StormEvent)
+	if !ok {
+		t.Fatalf("Expected second event to be a storm event, got: %#v", res.evs[1])
+	}
+
+	if sev.Count() != 3 {
+		t.Fatalf("Expected storm to have swallowed 3 directories, got: %d", sev.Count())
+	}
+
+	assertShutdown(t, m)
+}
+
+func TestStormAncestor(t *testing.T) {
+	sep := string(filepath.Separator)
+	for _, c := range []struct {
+		dirs     []string
+		expected string
+	}{
+		{[]string{sep + "a"}, sep + "a"},
+		{[]string{sep + "a" + sep + "b", sep + "a" + sep + "c"}, sep + "a"},
+		{[]string{sep + "a" + sep + "b", sep + "a" + sep + "bc"}, sep + "a"},
+		{[]string{sep + "a", sep + "a" + sep + "b" + sep + "c"}, sep + "a"},
+		{[]string{sep + "a", sep + "b"}, sep},
+	} {
+		anc := ancestor(c.dirs)
+		if anc != c.expected {
+			t.Fatalf("Expected ancestor of %v to be '%s', got: '%s'", c.dirs, c.expected, anc)
+		}
+	}
+}
+
+func TestWaitQuiet(t *testing.T) {
+	m := setupTestDirMonitor(t, Recursive)
+	done := waitForNEvents(t, m, 2, 2)
+	m.Start()
+
+	go func() {
+		doSettle()
+		doWriteFile(t, m, "#foobar", "file_1.md")
+		doWriteFile(t, m, "#foobar", "existing_dir", "file_1.md")
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+
+	dirs, err := m.WaitQuiet(ctx, Latency*2)
+	if err != nil {
+		t.Fatalf("Failed to wait for quiet: %s", err)
+	}
+
+	if len(dirs) != 2 || dirs[0] != m.Dir() || dirs[1] != filepath.Join(m.Dir(), "existing_dir") {
+		t.Fatalf("Expected both the root and the existing dir to be touched, got: %v", dirs)
+	}
+
+	res := <-done
+	assertNoErrors(t, res.errs)
+	assertShutdown(t, m)
+}
+
+func TestNewWithOptions(t *testing.T) {
+	tdir := setupTestDir(t)
+	m, err := NewWithOptions(tdir, WithSelector(NonRecursive), WithLatency(Latency), WithBuffer(2))
+	if err != nil {
+		t.Fatalf("Failed to create monitor: %s", err)
+	}
+
+	m.Start()
+	doWriteFile(t, m, "#foobar", "file_1.md")
+	doWriteFile(t, m, "#foobar", "existing_dir", "file_1.md")
+	doSettle()
+
+	//buffered, nobody was reading
+	if len(m.Events()) != 1 {
+		t.Fatalf("Expected a single buffered event, got: %d", len(m.Events()))
+	}
+
+	res := <-waitForNEvents(t, m, 1, 1)
+	assertNoErrors(t, res.errs)
+	assertNthDirEvent(t, res.evs, 1, m.Dir())
+	assertShutdown(t, m)
+}
+
+func TestNewWithInvalidOptions(t *testing.T) {
+	tdir := setupTestDir(t)
+	for _, opt := range []Option{
+		WithSelector(nil),
+		WithLatency(-time.Second),
+		WithBuffer(-1),
+		WithErrorHandler(nil),
+		WithStorm(-1, time.Second),
+		WithStorm(1, 0),
+		WithContentFilter(Recursive, 0),
+		WithWriteCompletion(-1),
+		WithOps(0),
+	} {
+		_, err := NewWithOptions(tdir, opt)
+		if err == nil {
+			t.Fatalf("Expected invalid option to fail")
+		}
+	}
+}
+
+func TestMissingRoot(t *testing.T) {
+	tdir := filepath.Join(setupTestDir(t), "missing_dir", "sub_dir")
+	_, err := New(tdir, Recursive, Latency)
+	if err == nil {
+		t.Fatalf("Expected a missing root to fail without waiting for it")
+	}
+
+	m, err := NewWithOptions(tdir, WithLatency(Latency), WithWaitForRoot())
+	if err != nil {
+		t.Fatalf("Failed to create monitor: %s", err)
+	}
+
+	_, err = m.Start()
+	if err != nil {
+		t.Fatalf("Failed to start while waiting for the root: %s", err)
+	}
+
+	assertCanEmit(t, m, m.Dir(), false)
+	doCreateFolders(t, m)
+	assertRootEvent(t, m, RootCreated)
+
+	done := waitForNEvents(t, m, 1, 1)
+	doWriteFile(t, m, "#foobar", "file_1.md")
+
+	res := <-done
+	assertNoErrors(t, res.errs)
+	assertNthDirEvent(t, res.evs, 1, m.Dir())
+	assertShutdown(t, m)
+}
+
+func TestMissingRootStopped(t *testing.T) {
+	tdir := filepath.Join(setupTestDir(t), "missing_dir")
+	m, err := NewWithOptions(tdir, WithLatency(Latency), WithWaitForRoot())
+	if err != nil {
+		t.Fatalf("Failed to create monitor: %s", err)
+	}
+
+	m.Start()
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Failed to stop while waiting for the root: %s", err)
+	}
+
+	done := waitForNEvents(t, m, 1, 1)
+	doCreateFolders(t, m)
+
+	res := <-done
+	assertTimeout(t, res.errs)
+	assertShutdown(t, m)
+}
+
+func assertFileEvent(t *testing.T, evs []DirEvent, path string) {
+	for _, ev := range evs {
+		fev, ok := ev.(FileEvent)
+		if !ok || fev.Path() != path {
+			t.Fatalf("Expected only file events for '%s', got: %#v", path, ev)
+		}
+	}
+}
+
+func TestFileWrite(t *testing.T) {
+	tdir := setupTestDir(t)
+	_, err := NewFile(filepath.Join(tdir, "existing_dir"))
+	if err == nil {
+		t.Fatalf("Expected a directory to not be accepted as file")
+	}
+
+	m, err := NewFile(filepath.Join(tdir, "existing_file_1.md"))
+	if err != nil {
+		t.Fatalf("Failed to create file monitor: %s", err)
+	}
+
+	done := waitForNEvents(t, m, 1, 1)
+	m.Start()
+
+	//right before the file is written its neighbour is
+	doWriteFile(t, m, "#foobar", "file_1.md")
+	path := doWriteFile(t, m, "#foobar", "existing_file_1.md")
+
+	res := <-done
+	assertNoErrors(t, res.errs)
+	assertFileEvent(t, res.evs, path)
+	assertCanEmit(t, m, path, true)
+	assertCanEmit(t, m, m.Dir(), false)
+	assertShutdown(t, m)
+}
+
+func TestFileNeighbourIgnored(t *testing.T) {
+	tdir := setupTestDir(t)
+	m, err := NewFile(filepath.Join(tdir, "existing_file_1.md"))
+	if err != nil {
+		t.Fatalf("Failed to create file monitor: %s", err)
+	}
+
+	done := waitForNEvents(t, m, 1, 1)
+	m.Start()
+
+	doWriteFile(t, m, "#foobar", "file_1.md")
+	doWriteFile(t, m, "#foobar", "existing_dir", "file_1.md")
+
+	res := <-done
+	assertTimeout(t, res.errs)
+	assertShutdown(t, m)
+}
+
+func TestFileStoppedUnread(t *testing.T) {
+	tdir := setupTestDir(t)
+	m, err := NewFile(filepath.Join(tdir, "existing_file_1.md"))
+	if err != nil {
+		t.Fatalf("Failed to create file monitor: %s", err)
+	}
+
+	m.Start()
+
+	//nobody reads the events of the file
+	doWriteFile(t, m, "#foobar", "existing_file_1.md")
+	doSettle()
+	doWriteFile(t, m, "#foobarbar", "existing_file_1.md")
+	doSettle()
+
+	stopped := make(chan error)
+	go func() {
+		stopped <- m.Stop()
+	}()
+
+	select {
+	case err = <-stopped:
+		if err != nil {
+			t.Fatalf("Failed to stop: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out stopping a file monitor of which the events are not read")
+	}
+}
+
+func TestFileAtomicReplace(t *testing.T) {
+	tdir := setupTestDir(t)
+	m, err := NewFile(filepath.Join(tdir, "existing_file_1.md"))
+	if err != nil {
+		t.Fatalf("Failed to create file monitor: %s", err)
+	}
+
+	done := waitForNEvents(t, m, 1, 1)
+	m.Start()
+
+	//same size, only the file it resolves to differs
+	doWriteFile(t, m, "", "existing_file_1.md.tmp")
+	doMove(t, m, "existing_file_1.md.tmp", "->", "existing_file_1.md")
+
+	res := <-done
+	assertNoErrors(t, res.errs)
+	assertFileEvent(t, res.evs, filepath.Join(m.Dir(), "existing_file_1.md"))
+	assertShutdown(t, m)
+}
+
+func TestFileConfigMapFlip(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Creating symlinks requires privileges on windows")
+	}
+
+	//the layout of a mounted Kubernetes ConfigMap
+	tdir := setupTestDir(t)
+	for _, link := range [][2]string{
+		{"..2021_01", "..data"},
+		{filepath.Join("..data", "config.yml"), "config.yml"},
+	} {
+		err := os.MkdirAll(filepath.Join(tdir, "..2021_01"), 0744)
+		if err != nil {
+			t.Fatalf("Failed to create data dir: %s", err)
+		}
+
+		err = os.Symlink(link[0], filepath.Join(tdir, link[1]))
+		if err != nil {
+			t.Fatalf("Failed to create symlink: %s", err)
+		}
+	}
+
+	m, err := NewFile(filepath.Join(tdir, "config.yml"))
+	if err != nil {
+		t.Fatalf("Failed to create file monitor: %s", err)
+	}
+
+	doWriteFile(t, m, "#foobar", "..2021_01", "config.yml")
+	done := waitForNEvents(t, m, 1, 1)
+	m.Start()
+
+	//a new version is written next to it and the data link swapped
+	doCreateFolders(t, m, "..2021_02")
+	doWriteFile(t, m, "#foobar", "..2021_02", "config.yml")
+	err = os.Symlink("..2021_02", filepath.Join(m.Dir(), "..data_tmp"))
+	if err != nil {
+		t.Fatalf("Failed to create symlink: %s", err)
+	}
+
+	doMove(t, m, "..data_tmp", "->", "..data")
+
+	res := <-done
+	assertNoErrors(t, res.errs)
+	assertFileEvent(t, res.evs, filepath.Join(m.Dir(), "config.yml"))
+	assertShutdown(t, m)
+}
+
+func TestStateOfflineChanges(t *testing.T) {
+	tdir := setupTestDir(t)
+	m, err := NewWithOptions(tdir, WithLatency(Latency), WithState(filepath.Join(filepath.Dir(tdir), "state")))
+	if err != nil {
+		t.Fatalf("Failed to create monitor: %s", err)
+	}
+
+	m.Start()
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Failed to stop: %s", err)
+	}
+
+	//while not running
+	doWriteFile(t, m, "#foobar", "existing_dir", "file_1.md")
+
+	done := waitForNEvents(t, m, 1, 2)
+	m.Start()
+
+	res := <-done
+	assertNoErrors(t, res.errs)
+	if len(res.evs) != 1 {
+		t.Fatalf("Expected only the offline change to be reported, got %d events", len(res.evs))
+	}
+
+	assertNthDirEvent(t, res.evs, 1, filepath.Join(m.Dir(), "existing_dir"))
+	assertShutdown(t, m)
+}
+
+func TestStateTokens(t *testing.T) {
+	tdir := setupTestDir(t)
+	state := filepath.Join(filepath.Dir(tdir), "state")
+	m, err := NewWithOptions(tdir, WithLatency(Latency), WithState(state))
+	if err != nil {
+		t.Fatalf("Failed to create monitor: %s", err)
+	}
+
+	done := waitForNEvents(t, m, 1, 1)
+	m.Start()
+	token := m.Token()
+	doWriteFile(t, m, "#foobar", "file_1.md")
+
+	res := <-done
+	assertNoErrors(t, res.errs)
+	assertSince(t, m, token, m.Dir())
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Failed to stop: %s", err)
+	}
+
+	//the token is still known after a restart of the process
+	doWriteFile(t, m, "#foobar", "existing_dir", "existing_sub_dir", "file_1.md")
+	m, err = NewWithOptions(m.Dir(), WithLatency(Latency), WithState(state))
+	if err != nil {
+		t.Fatalf("Failed to create monitor: %s", err)
+	}
+
+	done = waitForNEvents(t, m, 1, 1)
+	m.Start()
+
+	res = <-done
+	assertNoErrors(t, res.errs)
+	assertSince(t, m, token, m.Dir(), filepath.Join(m.Dir(), "existing_dir", "existing_sub_dir"))
+
+	_, err = m.Since("foreign:0")
+	if err != ErrTokenExpired {
+		t.Fatalf("Expected a foreign token to be expired, got: %v", err)
+	}
+
+	assertShutdown(t, m)
+}
+
+func TestVerifyNoDiscrepancies(t *testing.T) {
+	m := setupTestDirMonitor(t, Recursive, WithVerify(Latency, true))
+
+	done := waitForNEvents(t, m, 3, 3)
+	m.Start()
+
+	doWriteFile(t, m, "#foobar", "file_1.md")
+	doWriteFile(t, m, "#foobar", "existing_dir", "file_1.md")
+	doSettle()
+	doFlush(t, m)
+	doRemove(t, m, "existing_dir", "existing_sub_dir")
+
+	res := <-done
+	assertNoErrors(t, res.errs)
+	doSettle()
+	doSettle()
+	if m.Discrepancies() != 0 {
+		t.Fatalf("Expected no discrepancies, got: %d", m.Discrepancies())
+	}
+
+	assertShutdown(t, m)
+}
+
+func TestSparseExpandCollapse(t *testing.T) {
+	m := setupTestDirMonitor(t, Recursive, WithSparse(0))
+
+	dir := filepath.Join(m.Dir(), "existing_dir")
+	err := m.Expand(dir)
+	if err != nil {
+		t.Fatalf("Failed to expand '%s': %s", dir, err)
+	}
+
+	done := waitForNEvents(t, m, 1, 2)
+	m.Start()
+
+	//only the expanded directory, not what is below it
+	doWriteFile(t, m, "#foobar", "existing_dir", "existing_sub_dir", "file_1.md")
+	doWriteFile(t, m, "#foobar", "existing_dir", "file_1.md")
+
+	res := <-done
+	assertNoErrors(t, res.errs)
+	for _, ev := range res.evs {
+		if ev.Dir() != dir {
+			t.Fatalf("Expected only the expanded directory to emit, got an event for '%s'", ev.Dir())
+		}
+	}
+
+	assertNthDirEvent(t, res.evs, 1, dir)
+
+	err = m.Collapse(dir)
+	if err != nil {
+		t.Fatalf("Failed to collapse '%s': %s", dir, err)
+	}
+
+	err = m.Collapse(m.Dir())
+	if err == nil {
+		t.Fatalf("Expected collapsing the root to fail")
+	}
+
+	done = waitForNEvents(t, m, 1, 2)
+	doWriteFile(t, m, "#foobar", "existing_dir", "file_2.md")
+	doWriteFile(t, m, "#foobar", "file_1.md")
+
+	res = <-done
+	assertNoErrors(t, res.errs)
+	for _, ev := range res.evs {
+		if ev.Dir() != m.Dir() {
+			t.Fatalf("Expected only the root to emit, got an event for '%s'", ev.Dir())
+		}
+	}
+
+	assertNthDirEvent(t, res.evs, 1, m.Dir())
+	assertShutdown(t, m)
+}
+
+func TestSparseExpandLinkedRoot(t *testing.T) {
+	link := setupLinkedTestDir(t)
+	m, err := NewWithOptions(link, WithLatency(Latency), WithSparse(0))
+	if err != nil {
+		t.Fatalf("Failed to create monitor: %s", err)
+	}
+
+	//the path goes through the link, the events don't
+	dir := filepath.Join(link, "existing_dir")
+	err = m.Expand(dir)
+	if err != nil {
+		t.Fatalf("Failed to expand '%s': %s", dir, err)
+	}
+
+	err = m.Collapse(link)
+	if err == nil {
+		t.Fatalf("Expected collapsing the root through its link to fail")
+	}
+
+	done := waitForNEvents(t, m, 1, 1)
+	m.Start()
+
+	doWriteFile(t, m, "#foobar", "existing_dir", "file_1.md")
+	res := <-done
+	assertNoErrors(t, res.errs)
+	assertNthDirEvent(t, res.evs, 1, filepath.Join(m.Dir(), "existing_dir"))
+
+	err = m.Collapse(dir)
+	if err != nil {
+		t.Fatalf("Failed to collapse '%s': %s", dir, err)
+	}
+
+	assertShutdown(t, m)
+}
+
+func TestSparseBudget(t *testing.T) {
+	m := setupTestDirMonitor(t, Recursive, WithSparse(2))
+
+	done := waitForNEvents(t, m, 1, 1)
+	m.Start()
+
+	//activity makes directories watched, the root and one more fit the budget
+	doCreateFolders(t, m, "dir_a")
+	res := <-done
+	assertNoErrors(t, res.errs)
+	doSettle()
+
+	done = waitForNEvents(t, m, 1, 1)
+	doCreateFolders(t, m, "dir_b")
+	res = <-done
+	assertNoErrors(t, res.errs)
+	doSettle()
+
+	done = waitForNEvents(t, m, 1, 1)
+	doWriteFile(t, m, "#foobar", "dir_a", "file_1.md")
+	res = <-done
+	assertTimeout(t, res.errs)
+
+	done = waitForNEvents(t, m, 1, 1)
+	doWriteFile(t, m, "#foobar", "dir_b", "file_1.md")
+	res = <-done
+	assertNoErrors(t, res.errs)
+	assertNthDirEvent(t, res.evs, 1, filepath.Join(m.Dir(), "dir_b"))
+	assertShutdown(t, m)
+}
+
 func TestDoubleStartAndStop(t *testing.T) {
 	m := setupTestDirMonitor(t, Recursive)
 
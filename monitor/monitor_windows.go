@@ -13,6 +13,23 @@ import (
 
 const bufferSize = 4096
 
+var supportedOps = Create | Write | Remove | Rename | Attrib | Access
+
+//ReadDirectoryChangesW doesn't report changes in the targets of symlinks
+var canFollow = false
+
+//ReadDirectoryChangesW takes care of mount points itself
+var canMount = false
+
+//there is no mount table to watch
+var canWatchMounts = false
+
+//ReadDirectoryChangesW tells what entry an event is for
+var canName = true
+
+//there is nothing to share between monitors
+var canShare = false
+
 type Monitor struct {
 	handle syscall.Handle
 	cph    syscall.Handle
@@ -37,15 +54,55 @@ func (m *Monitor) readDirChanges(h syscall.Handle, pBuff *byte, ov *syscall.Over
 		h,
 		pBuff,
 		uint32(bufferSize),
-		true,
-		syscall.FILE_NOTIFY_CHANGE_SIZE|syscall.FILE_NOTIFY_CHANGE_FILE_NAME|syscall.FILE_NOTIFY_CHANGE_DIR_NAME,
+		!m.shallow,
+		m.filter(),
 		nil,
 		(*syscall.Overlapped)(unsafe.Pointer(ov)),
 		0,
 	)
 }
 
+//what to be notified of for the kinds of changes that are observed
+func (m *Monitor) filter() uint32 {
+	var filter uint32
+	if m.ops&(Create|Remove|Rename) != 0 {
+		filter |= syscall.FILE_NOTIFY_CHANGE_FILE_NAME | syscall.FILE_NOTIFY_CHANGE_DIR_NAME
+	}
+
+	if m.ops&Write != 0 {
+		filter |= syscall.FILE_NOTIFY_CHANGE_SIZE
+	}
+
+	if m.ops&Attrib != 0 {
+		filter |= syscall.FILE_NOTIFY_CHANGE_ATTRIBUTES
+	}
+
+	if m.ops&Access != 0 {
+		filter |= syscall.FILE_NOTIFY_CHANGE_LAST_ACCESS
+	}
+
+	return filter
+}
+
+//windows doesn't tell what kind of modification took place
+func opOf(action uint32) Op {
+	switch action {
+	case syscall.FILE_ACTION_ADDED:
+		return Create
+	case syscall.FILE_ACTION_REMOVED:
+		return Remove
+	case syscall.FILE_ACTION_RENAMED_OLD_NAME, syscall.FILE_ACTION_RENAMED_NEW_NAME:
+		return Rename
+	}
+
+	return Write | Attrib | Access
+}
+
 func (m *Monitor) Stop() error {
+	if m.unwait() {
+		return nil
+	}
+
 	err := m.monitor.Stop()
 	if err != nil {
 		return err
@@ -61,10 +118,14 @@ func (m *Monitor) Stop() error {
 		return os.NewSyscallError("CloseHandle", err)
 	}
 
-	return nil
+	return m.save()
 }
 
 func (m *Monitor) Start() (chan DirEvent, error) {
+	if m.awaitRoot() {
+		return m.Events(), nil
+	}
+
 	err := m.monitor.Start()
 	if err != nil {
 		return m.Events(), err
@@ -120,7 +181,7 @@ func (m *Monitor) Start() (chan DirEvent, error) {
 			switch err {
 			case syscall.ERROR_MORE_DATA:
 				if ov == nil {
-					m.errors <- fmt.Errorf("ERROR_MORE_DATA has unexpectedly null lpOverlapped buffer")
+					m.fail(fmt.Errorf("ERROR_MORE_DATA has unexpectedly null lpOverlapped buffer"))
 				} else {
 					n = uint32(unsafe.Sizeof(buffer))
 				}
@@ -130,7 +191,7 @@ func (m *Monitor) Start() (chan DirEvent, error) {
 			case syscall.ERROR_OPERATION_ABORTED:
 				continue
 			default:
-				m.errors <- os.NewSyscallError("GetQueuedCompletionPort", err)
+				m.fail(os.NewSyscallError("GetQueuedCompletionPort", err))
 				continue
 			case nil:
 			}
@@ -138,7 +199,7 @@ func (m *Monitor) Start() (chan DirEvent, error) {
 			var offset uint32
 			for {
 				if n == 0 {
-					m.errors <- fmt.Errorf("short read in readEvents()")
+					m.fail(fmt.Errorf("short read in readEvents()"))
 					break
 				}
 
@@ -151,9 +212,9 @@ func (m *Monitor) Start() (chan DirEvent, error) {
 
 				res, err := m.IsSelected(clean)
 				if err != nil {
-					m.errors <- err
+					m.fail(err)
 				} else if res {
-					m.unthrottled <- &mevent{clean}
+					m.unthrottled <- &mevent{clean, filepath.Base(fullname), opOf(raw.Action)}
 				}
 
 				if raw.NextEntryOffset == 0 {
@@ -162,7 +223,7 @@ func (m *Monitor) Start() (chan DirEvent, error) {
 
 				offset += raw.NextEntryOffset
 				if offset >= n {
-					m.errors <- fmt.Errorf("Windows system assumed buffer larger than it is, events have likely been missed.")
+					m.fail(fmt.Errorf("Windows system assumed buffer larger than it is, events have likely been missed."))
 					break
 				}
 			}
@@ -171,12 +232,13 @@ func (m *Monitor) Start() (chan DirEvent, error) {
 			if n != 0 && !m.stopped {
 				err = m.readDirChanges(m.handle, &buffer[0], overlapped)
 				if err != nil {
+					//the root directory was removed, renaming it is not noticed
 					if err == syscall.ERROR_ACCESS_DENIED {
-						m.Stop()
+						m.gone(RootRemoved)
 						continue
 					}
 
-					m.errors <- os.NewSyscallError("readDirChanges", err)
+					m.fail(os.NewSyscallError("readDirChanges", err))
 				}
 			}
 		}
@@ -187,5 +249,6 @@ func (m *Monitor) Start() (chan DirEvent, error) {
 		return nil, os.NewSyscallError("ReadDirectoryChanges", err)
 	}
 
+	m.replay()
 	return m.Events(), nil
 }
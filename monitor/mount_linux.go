@@ -0,0 +1,197 @@
+// +build linux
+
+package monitor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+//the kernel lists the mounts of this process here, when they change
+//an open descriptor of it becomes readable with priority data
+var mountinfo = "/proc/self/mountinfo"
+
+//reads the mount points at or below the root and the device that is mounted
+//at each of them, for stacked mounts the top most one is what is visible
+func readMounts(root string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(mountinfo)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read mounts from '%s': %s", mountinfo, err)
+	}
+
+	mounts := map[string]string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		//id, parent id, major:minor, root, mount point, ...
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+
+		point := unescapeMount(fields[4])
+		if point == root || strings.HasPrefix(point, root+string(filepath.Separator)) {
+			mounts[point] = fields[2]
+		}
+	}
+
+	return mounts, nil
+}
+
+//mountinfo escapes whitespace and backslashes as three octal digits
+func unescapeMount(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b = append(b, byte(c))
+				i += 3
+				continue
+			}
+		}
+
+		b = append(b, s[i])
+	}
+
+	return string(b)
+}
+
+//returns the nearest mount point below the root that is the directory or one
+//of its parents, empty if the directory is on the file system of the root
+func (m *Monitor) mountOf(dir string) string {
+	for p := dir; p != m.Dir() && p != filepath.Dir(p); p = filepath.Dir(p) {
+		if _, ok := m.mountpoints[p]; ok {
+			return p
+		}
+	}
+
+	return ""
+}
+
+//the file system of a watched directory was unmounted and the kernel removed
+//its watch. Only the mount point itself is reported, from then on the directory
+//it covered is watched. When it is the file system of the root there is nothing
+//left to watch
+func (m *Monitor) handleUnmount(dir string) {
+	if m.stopped {
+		return
+	}
+
+	if dir == m.Dir() {
+		m.gone(RootUnmounted)
+		return
+	}
+
+	m.Lock()
+	m.removePath(dir)
+	m.Unlock()
+
+	if m.mountOf(dir) != dir {
+		return
+	}
+
+	delete(m.mountpoints, dir)
+	m.remount(dir, false)
+}
+
+//the mount table changed: mount points that appeared (or of which the device
+//changed) below the root are watched anew, those that disappeared without
+//their file system being unmounted (bind mounts) are replaced by what they covered
+func (m *Monitor) handleMountChange() {
+	mounts, err := readMounts(m.Dir())
+	if err != nil {
+		m.fail(err)
+		return
+	}
+
+	changed := map[string]bool{}
+	for point, dev := range mounts {
+		if prev, ok := m.mountpoints[point]; !ok || prev != dev {
+			changed[point] = true
+		}
+	}
+
+	for point := range m.mountpoints {
+		if _, ok := mounts[point]; !ok {
+			changed[point] = false
+		}
+	}
+
+	//parents first, such that nested mounts end up with the watches of their own
+	points := []string{}
+	for point := range changed {
+		if point != m.Dir() {
+			points = append(points, point)
+		}
+	}
+
+	sort.Strings(points)
+	m.mountpoints = mounts
+	for _, point := range points {
+		if m.stopped {
+			return
+		}
+
+		m.remount(point, changed[point])
+	}
+}
+
+//replaces the watches at and below a mount point with those for what is
+//visible there now, the change is reported once these are in place
+func (m *Monitor) remount(dir string, mounted bool) {
+	if res, err := m.IsSelected(dir); !res || err != nil {
+		return
+	}
+
+	m.unwatch(dir)
+	err := m.watchTree(dir)
+	if err != nil && !os.IsNotExist(err) {
+		m.fail(fmt.Errorf("Failed to watch mount point '%s': %s", dir, err))
+	}
+
+	m.emit(&mountEvent{dir, mounted})
+}
+
+//opens the mount table such that epoll notifies of changes to it
+func (m *Monitor) watchMounts() error {
+	var err error
+	m.mfd, err = syscall.Open(mountinfo, syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return os.NewSyscallError("Open", err)
+	}
+
+	if m.shared {
+		return inotify.watchMounts(m)
+	}
+
+	m.epes = append(m.epes, syscall.EpollEvent{Events: syscall.EPOLLPRI, Fd: int32(m.mfd)})
+	err = syscall.EpollCtl(m.epfd, syscall.EPOLL_CTL_ADD, m.mfd, &m.epes[len(m.epes)-1])
+	if err != nil {
+		return os.NewSyscallError("EpollCtl", err)
+	}
+
+	return nil
+}
+
+//closes the mount table, if it was opened
+func (m *Monitor) closeMounts() error {
+	if m.mfd < 0 {
+		return nil
+	}
+
+	err := syscall.Close(m.mfd)
+	if err != nil {
+		return os.NewSyscallError("Close", err)
+	}
+
+	m.mfd = -1
+	return nil
+}
@@ -0,0 +1,62 @@
+package monitor
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+//the kinds of changes that are observed by default
+var DefaultOps = Create | Write | Remove | Rename
+
+var opNames = []struct {
+	op   Op
+	name string
+}{
+	{Create, "create"},
+	{Write, "write"},
+	{Remove, "remove"},
+	{Rename, "rename"},
+	{Attrib, "attrib"},
+	{Access, "access"},
+}
+
+func (op Op) String() string {
+	names := []string{}
+	for _, n := range opNames {
+		if op&n.op == n.op {
+			names = append(names, n.name)
+		}
+	}
+
+	if len(names) == 0 {
+		return "unknown"
+	}
+
+	return strings.Join(names, "|")
+}
+
+//see WithOps()
+func (m *monitor) setOps(op Op) error {
+	if op == 0 {
+		return fmt.Errorf("At least one kind of change needs to be observed")
+	}
+
+	if unsupported := op &^ supportedOps; unsupported != 0 {
+		return fmt.Errorf("Observing changes of kind '%s' is not supported on %s", unsupported, runtime.GOOS)
+	}
+
+	m.ops = op
+	return nil
+}
+
+//events of a kind that is not observed are not emitted, events
+//of which the backend doesn't know the kind always are
+func (m *monitor) isIgnoredOp(ev DirEvent) bool {
+	mev, ok := ev.(*mevent)
+	if !ok || mev.op == 0 {
+		return false
+	}
+
+	return mev.op&m.ops == 0
+}
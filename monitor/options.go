@@ -0,0 +1,260 @@
+package monitor
+
+import (
+	"fmt"
+	"time"
+)
+
+//Option configures a monitor that is created with NewWithOptions
+type Option func(c *config) error
+
+type config struct {
+	sel     Selector
+	latency time.Duration
+	wait    bool
+	setup   []func(m M) error
+}
+
+//all monitors embed the abstract monitor
+type based interface {
+	base() *monitor
+}
+
+func (m *monitor) base() *monitor { return m }
+
+//NewWithOptions creates a monitor for the given directory, without
+//options it behaves exactly like New(dir, nil, 0)
+func NewWithOptions(dir string, opts ...Option) (M, error) {
+	c := &config{}
+	for _, opt := range opts {
+		err := opt(c)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid option for monitor of '%s': %s", dir, err)
+		}
+	}
+
+	fn := New
+	if c.wait {
+		fn = create
+	}
+
+	m, err := fn(dir, c.sel, c.latency)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, setup := range c.setup {
+		err = setup(m)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to configure monitor of '%s': %s", dir, err)
+		}
+	}
+
+	return m, nil
+}
+
+//WithSelector determines what directories are monitored, default is Recursive
+func WithSelector(sel Selector) Option {
+	return func(c *config) error {
+		if sel == nil {
+			return fmt.Errorf("Selector cannot be nil")
+		}
+
+		c.sel = sel
+		return nil
+	}
+}
+
+//WithLatency sets how long events for the same directory are throttled
+func WithLatency(latency time.Duration) Option {
+	return func(c *config) error {
+		if latency <= 0 {
+			return fmt.Errorf("Latency must be positive, got: %s", latency)
+		}
+
+		c.latency = latency
+		return nil
+	}
+}
+
+//WithBuffer sets the buffer size of the events and errors channels
+func WithBuffer(size int) Option {
+	return func(c *config) error {
+		if size < 0 {
+			return fmt.Errorf("Buffer size cannot be negative, got: %d", size)
+		}
+
+		c.setup = append(c.setup, func(m M) error {
+			mon := m.(based).base()
+			mon.events = make(chan DirEvent, size)
+			mon.errors = make(chan error, size)
+			return nil
+		})
+
+		return nil
+	}
+}
+
+//WithErrorHandler passes all errors to the given function
+//instead of sending them over the Errors() channel
+func WithErrorHandler(fn func(err error)) Option {
+	return func(c *config) error {
+		if fn == nil {
+			return fmt.Errorf("Error handler cannot be nil")
+		}
+
+		c.setup = append(c.setup, func(m M) error {
+			m.(based).base().handler = fn
+			return nil
+		})
+
+		return nil
+	}
+}
+
+//WithStorm enables storm mode: when more then threshold distinct directories
+//change within the window no individual events are emitted anymore. Instead,
+//once no directory changed for a whole window, a single StormEvent is emitted
+//for the lowest common ancestor of all of them. A threshold of 0 disables it
+func WithStorm(threshold int, window time.Duration) Option {
+	return setup(func(m *monitor) error { return m.setStorm(threshold, window) })
+}
+
+//WithContentFilter enables hashing the content of files up to the given size in
+//directories that match the selector, events for those directories are only
+//emitted when their content actually changed. It is primed on Start()
+func WithContentFilter(sel Selector, limit int64) Option {
+	return setup(func(m *monitor) error { return m.setContentFilter(sel, limit) })
+}
+
+//WithEditorFilter enables the filtering of events that are caused
+//by the swap, backup, lock and temporary files of editors
+func WithEditorFilter() Option {
+	return setup(func(m *monitor) error { return m.setEditorFilter(true) })
+}
+
+//WithWriteCompletion enables reporting changes to files only once they are
+//completely written. Backends that know when a file is closed after writing
+//(inotify) use that, others wait until the size and modtime of all entries in a
+//directory didn't change for the given number of latency intervals
+func WithWriteCompletion(intervals int) Option {
+	return setup(func(m *monitor) error { return m.setWriteCompletion(intervals) })
+}
+
+//WithOps configures what kinds of changes are observed, not every backend is
+//able to observe all of them. Access events include the reads of the monitor
+//itself: it lists directories when it starts and when they are created, and
+//verification, state, polling and the content filter read the tree as well
+func WithOps(op Op) Option {
+	return setup(func(m *monitor) error { return m.setOps(op) })
+}
+
+//WithFollowSymlinks enables watching symlinked directories inside the tree,
+//changes in them are reported under the path of the link. Not all backends
+//support this
+func WithFollowSymlinks() Option {
+	return setup(func(m *monitor) error { return m.setFollowSymlinks(true) })
+}
+
+//WithSameFilesystem stops at mount points below the root,
+//such that only the file system of the root is monitored
+func WithSameFilesystem() Option {
+	return setup(func(m *monitor) error { return m.setSameFilesystem(true) })
+}
+
+//WithPollFallback enables polling at the given interval for subtrees on
+//file systems that are known to not notify (reliably) of changes, such
+//as network file systems. An interval of 0 disables it
+func WithPollFallback(interval time.Duration) Option {
+	return setup(func(m *monitor) error { return m.setPollFallback(interval) })
+}
+
+//WithMountWatch enables watching the mount table, such that file systems
+//that are mounted inside the tree after it started are monitored as well.
+//Unmounts are always detected by backends that support this
+func WithMountWatch() Option {
+	return setup(func(m *monitor) error { return m.setMountWatch(true) })
+}
+
+//WithShared shares the resources of the backend with the other monitors in
+//the process that are created with it. On Linux they all use one inotify
+//instance, with a single watch for a directory that several of them watch,
+//instead of each one opening its own. Not all backends support this
+func WithShared() Option {
+	return setup(func(m *monitor) error { return m.setShared(true) })
+}
+
+//WithPersistentRoot survives the removal of the root directory. Instead of
+//stopping, the monitor then watches the parents of the root until a directory
+//appears at its path again, and starts over from there after emitting a RootEvent
+//with RootCreated as reason. Just like with Stop() pending calls to Flush() and
+//WaitQuiet() fail once the root is gone
+func WithPersistentRoot() Option {
+	return setup(func(m *monitor) error { return m.setPersistentRoot(true) })
+}
+
+//WithVerify enables walking the selected tree in the background at the lowest I/O
+//priority the platform offers, every interval. Directories that changed since the
+//previous walk without the backend noticing are reported with an event, and counted
+//by Discrepancies(). When adaptive, the interval halves after a walk that caught
+//something and doubles after one that didn't, staying between an eighth and eight
+//times the given interval and at least ten times as long as a walk takes. An
+//interval of 0 disables it
+func WithVerify(interval time.Duration, adaptive bool) Option {
+	return setup(func(m *monitor) error { return m.setVerify(interval, adaptive) })
+}
+
+//WithSparse enables sparse mode: instead of the whole tree only the root and the
+//given directories are watched, more can be added with Expand(). With a budget,
+//directories that are named by events in watched directories are watched as well,
+//as long as the total stays within the budget. The least recently active of those
+//make way for new ones. Backends that watch the tree as a whole, as on Windows
+//and OSX, keep doing so but only emit events for the watched directories
+func WithSparse(budget int, frontier ...string) Option {
+	return setup(func(m *monitor) error {
+		err := m.setSparse(true, budget)
+		for _, dir := range frontier {
+			if err != nil {
+				break
+			}
+
+			err = m.Expand(dir)
+		}
+
+		return err
+	})
+}
+
+//WithState persists the state of the monitor in the given file. On Stop() the
+//listing of all selected directories is written to it, with the contents hashed
+//when a content filter is set. On Start() it is compared with what is on disk and
+//an event is emitted for each directory that changed in the meantime, before any
+//other event. The history of tokens is persisted as well, see Since(). The file
+//is best kept outside of the tree and an empty path disables it
+func WithState(path string) Option {
+	return setup(func(m *monitor) error { return m.setState(path) })
+}
+
+//WithWaitForRoot allows the root to not exist yet. Starting the monitor then
+//watches the nearest parent that does exist until the root is created, at which
+//point a RootEvent with RootCreated as reason is emitted and monitoring begins.
+//Stopping the monitor in the meantime cancels the waiting
+func WithWaitForRoot() Option {
+	return func(c *config) error {
+		c.wait = true
+		c.setup = append(c.setup, func(m M) error {
+			m.(based).base().absent = true
+			return nil
+		})
+
+		return nil
+	}
+}
+
+//configuration is applied to the abstract monitor that every monitor embeds
+func setup(fn func(m *monitor) error) Option {
+	return func(c *config) error {
+		c.setup = append(c.setup, func(m M) error { return fn(m.(based).base()) })
+		return nil
+	}
+}
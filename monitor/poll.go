@@ -0,0 +1,159 @@
+package monitor
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/timeglass/snow/snapshot"
+)
+
+//poller periodically compares the listings of directory trees, it is used
+//for file systems that are known to not notify (reliably) of changes
+type poller struct {
+	m        *monitor
+	interval time.Duration
+	roots    map[string]struct{}
+	dirs     map[string]struct{}
+	pending  map[string]int
+	snap     *snapshot.Snapshot
+	stop     chan struct{}
+	started  bool
+	sync.Mutex
+}
+
+func newPoller(m *monitor, interval time.Duration) *poller {
+	return &poller{
+		m:        m,
+		interval: interval,
+		roots:    map[string]struct{}{},
+		dirs:     map[string]struct{}{},
+		pending:  map[string]int{},
+		snap:     snapshot.New(),
+		stop:     make(chan struct{}),
+	}
+}
+
+//add starts polling the tree below the given directory
+func (p *poller) add(root string) error {
+	p.Lock()
+	defer p.Unlock()
+	if _, ok := p.roots[root]; ok {
+		return nil
+	}
+
+	p.roots[root] = struct{}{}
+	err := p.m.walkSelected(root, func(dir string) error {
+		p.dirs[dir] = struct{}{}
+		return p.snap.Take(dir)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if !p.started {
+		p.started = true
+		go p.run()
+	}
+
+	return nil
+}
+
+//has returns whether a directory is being polled
+func (p *poller) has(dir string) bool {
+	p.Lock()
+	defer p.Unlock()
+	_, ok := p.dirs[dir]
+	return ok
+}
+
+func (p *poller) close() {
+	p.Lock()
+	defer p.Unlock()
+	if p.started {
+		close(p.stop)
+		p.started = false
+	}
+}
+
+func (p *poller) run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			for _, dir := range p.poll() {
+				select {
+				case p.m.unthrottled <- &mevent{dir, "", 0}:
+				case <-p.stop:
+					return
+				}
+			}
+		}
+	}
+}
+
+//poll walks all trees and returns the directories that changed, in write
+//completion mode only once they didn't change for the required number of polls
+func (p *poller) poll() []string {
+	p.Lock()
+	defer p.Unlock()
+
+	seen := map[string]struct{}{}
+	changed := []string{}
+	for root := range p.roots {
+		err := p.m.walkSelected(root, func(dir string) error {
+			seen[dir] = struct{}{}
+			d, err := p.snap.Diff(dir)
+			if err != nil {
+				return err
+			}
+
+			if !d.Empty() {
+				changed = append(changed, dir)
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			p.m.fail(err)
+		}
+	}
+
+	//directories that are gone changed as well
+	for dir := range p.dirs {
+		if _, ok := seen[dir]; !ok {
+			p.snap.Forget(dir)
+			changed = append(changed, dir)
+		}
+	}
+
+	p.dirs = seen
+	if p.m.completion == 0 {
+		sort.Strings(changed)
+		return changed
+	}
+
+	//changed directories start counting again after this poll
+	for _, dir := range changed {
+		p.pending[dir] = -1
+	}
+
+	stable := []string{}
+	for dir, n := range p.pending {
+		if n+1 >= p.m.completion {
+			stable = append(stable, dir)
+			delete(p.pending, dir)
+			continue
+		}
+
+		p.pending[dir] = n + 1
+	}
+
+	sort.Strings(stable)
+	return stable
+}
@@ -0,0 +1,86 @@
+package monitor
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+//someone waiting for the monitor to become quiet
+type quiet struct {
+	dirs map[string]struct{}
+	last time.Time
+	kick chan struct{}
+	done chan error
+}
+
+//touch is called by the throttle for every directory that changed,
+//it is remembered by everyone waiting for things to quiet down
+func (m *monitor) touch(dir string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, q := range m.quiets {
+		q.dirs[dir] = struct{}{}
+		q.last = time.Now()
+		select {
+		case q.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+//WaitQuiet blocks until at least one change came in and no other changes followed
+//for the given duration. It returns all directories that changed during the burst
+func (m *monitor) WaitQuiet(ctx context.Context, d time.Duration) ([]string, error) {
+	if m.stopped == true {
+		return nil, ErrAlreadyStopped
+	}
+
+	q := &quiet{
+		dirs: map[string]struct{}{},
+		kick: make(chan struct{}, 1),
+		done: make(chan error, 1),
+	}
+
+	m.mu.Lock()
+	m.quieting++
+	id := m.quieting
+	m.quiets[id] = q
+	m.mu.Unlock()
+
+	defer func() {
+		m.mu.Lock()
+		delete(m.quiets, id)
+		m.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(d)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		select {
+		case <-q.kick:
+			timer.Reset(d)
+		case <-timer.C:
+			m.mu.Lock()
+			if time.Since(q.last) < d {
+				timer.Reset(d - time.Since(q.last))
+				m.mu.Unlock()
+				continue
+			}
+
+			dirs := []string{}
+			for dir := range q.dirs {
+				dirs = append(dirs, dir)
+			}
+
+			m.mu.Unlock()
+			sort.Strings(dirs)
+			return dirs, nil
+		case err := <-q.done:
+			return nil, err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package monitor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+//emitted when the root directory went away or came back
+type rootEvent struct {
+	dir    string
+	reason Reason
+}
+
+func (r *rootEvent) Dir() string    { return r.dir }
+func (r *rootEvent) Reason() Reason { return r.reason }
+
+//see WithPersistentRoot()
+func (m *monitor) setPersistentRoot(enabled bool) error {
+	m.persist = enabled
+	return nil
+}
+
+//the root directory was removed, renamed or unmounted. The monitor stops or,
+//with a persistent root, waits for a directory to appear at its path again. It
+//is reported after stopping, such that nothing follows the event
+func (m *monitor) gone(reason Reason) {
+	m.self.Stop()
+	if !m.persist {
+		m.events <- &rootEvent{m.dir, reason}
+		return
+	}
+
+	cancel := make(chan struct{})
+	m.mu.Lock()
+	m.waiting = cancel
+	m.mu.Unlock()
+
+	m.events <- &rootEvent{m.dir, reason}
+	go m.await(cancel)
+}
+
+//a monitor created with WithWaitForRoot() waits in the background for
+//a missing root when it is started, returns whether that is the case
+func (m *monitor) awaitRoot() bool {
+	if !m.absent || !m.stopped || isDir(m.dir) {
+		return false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.waiting == nil {
+		m.waiting = make(chan struct{})
+		go m.await(m.waiting)
+	}
+
+	return true
+}
+
+//a monitor that waits for its root is already stopped, stopping
+//it ends the waiting. Returns whether it was waiting
+func (m *monitor) unwait() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.waiting == nil {
+		return false
+	}
+
+	close(m.waiting)
+	m.waiting = nil
+	return true
+}
+
+//waits for a directory at the path of the root by watching the nearest parent
+//that exists, climbing up when that one goes away as well. Unless waiting is
+//cancelled in the meantime the monitor starts over once it is there
+func (m *monitor) await(cancel chan struct{}) {
+	for !isDir(m.dir) {
+		parent := m.dir
+		for parent != filepath.Dir(parent) && !isDir(parent) {
+			parent = filepath.Dir(parent)
+		}
+
+		w, err := New(parent, NonRecursive, m.latency)
+		if err == nil {
+			w.(based).base().shallow = true
+			_, err = w.Start()
+		}
+
+		if err != nil {
+			m.fail(fmt.Errorf("Failed to watch '%s' for the root to appear: %s", parent, err))
+			return
+		}
+
+		//it might have appeared before its parent was watched
+		if !isDir(m.dir) {
+			select {
+			case <-w.Events():
+			case err := <-w.Errors():
+				m.fail(err)
+			case <-cancel:
+				halt(w)
+				return
+			}
+		}
+
+		halt(w)
+	}
+
+	m.mu.Lock()
+	if m.waiting != cancel {
+		m.mu.Unlock()
+		return
+	}
+
+	m.waiting = nil
+	m.mu.Unlock()
+
+	_, err := m.self.Start()
+	if err != nil {
+		m.fail(fmt.Errorf("Failed to restart monitor for '%s': %s", m.dir, err))
+		return
+	}
+
+	m.unthrottled <- &rootEvent{m.dir, RootCreated}
+}
+
+//stops a monitor of which nobody reads the events anymore, events
+//and errors that are still on their way are discarded until it stopped
+func halt(m M) error {
+	stopped := make(chan error)
+	go func() {
+		stopped <- m.Stop()
+	}()
+
+	for {
+		select {
+		case <-m.Events():
+		case <-m.Errors():
+		case err := <-stopped:
+			return err
+		}
+	}
+}
+
+//evaluates the symlinks in the part of the path that exists, the rest
+//is appended as is for a root that will be created later on
+func resolve(dir string) (string, error) {
+	rdir, err := filepath.EvalSymlinks(dir)
+	if err == nil || !os.IsNotExist(err) || filepath.Dir(dir) == dir {
+		return rdir, err
+	}
+
+	parent, err := resolve(filepath.Dir(dir))
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(parent, filepath.Base(dir)), nil
+}
+
+//makes a path absolute and evaluates the symlinks on the way to it, like those
+//of the root, but not a link at the path itself as that is what events are for
+func resolveParent(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	if filepath.Dir(abs) == abs {
+		return abs, nil
+	}
+
+	parent, err := resolve(filepath.Dir(abs))
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(parent, filepath.Base(abs)), nil
+}
+
+func isDir(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
@@ -0,0 +1,254 @@
+package monitor
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNotSparse = errors.New("The monitor is not in sparse mode")
+
+//the directories that are watched in sparse mode, see WithSparse()
+type sparse struct {
+	budget int
+	pinned map[string]struct{}
+	auto   map[string]time.Time
+	sync.Mutex
+}
+
+//backends that watch directories one by one
+type sparser interface {
+	watchDir(dir string) error
+	unwatchDir(dir string)
+}
+
+func (s *sparse) has(dir string) bool {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.pinned[dir]; ok {
+		return true
+	}
+
+	_, ok := s.auto[dir]
+	return ok
+}
+
+func (s *sparse) dirs() []string {
+	s.Lock()
+	defer s.Unlock()
+	dirs := []string{}
+	for dir := range s.pinned {
+		dirs = append(dirs, dir)
+	}
+
+	for dir := range s.auto {
+		dirs = append(dirs, dir)
+	}
+
+	sort.Strings(dirs)
+	return dirs
+}
+
+func (s *sparse) pin(dir string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.auto, dir)
+	s.pinned[dir] = struct{}{}
+}
+
+//forgets a directory and everything below it, returns what was forgotten
+func (s *sparse) drop(dir string) []string {
+	s.Lock()
+	defer s.Unlock()
+	dropped := []string{}
+	below := func(path string) bool {
+		return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+	}
+
+	for path := range s.pinned {
+		if below(path) {
+			delete(s.pinned, path)
+			dropped = append(dropped, path)
+		}
+	}
+
+	for path := range s.auto {
+		if below(path) {
+			delete(s.auto, path)
+			dropped = append(dropped, path)
+		}
+	}
+
+	sort.Strings(dropped)
+	return dropped
+}
+
+//marks an automatically watched directory as active
+func (s *sparse) touch(dir string) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.auto[dir]; ok {
+		s.auto[dir] = time.Now()
+	}
+}
+
+//adds an automatically watched directory, returns the least recently active
+//ones that no longer fit the budget and whether the directory itself fits
+func (s *sparse) add(dir string) ([]string, bool) {
+	s.Lock()
+	defer s.Unlock()
+	room := s.budget - len(s.pinned)
+	if room <= 0 {
+		return nil, false
+	}
+
+	s.auto[dir] = time.Now()
+	evicted := []string{}
+	for len(s.auto) > room {
+		coldest := ""
+		for path, active := range s.auto {
+			if coldest == "" || active.Before(s.auto[coldest]) {
+				coldest = path
+			}
+		}
+
+		delete(s.auto, coldest)
+		evicted = append(evicted, coldest)
+	}
+
+	return evicted, true
+}
+
+//see WithSparse()
+func (m *monitor) setSparse(enabled bool, budget int) error {
+	if budget < 0 {
+		return fmt.Errorf("Watch budget cannot be negative, got: %d", budget)
+	}
+
+	m.sparse = nil
+	if enabled {
+		m.sparse = &sparse{
+			budget: budget,
+			pinned: map[string]struct{}{m.dir: struct{}{}},
+			auto:   map[string]time.Time{},
+		}
+	}
+
+	return nil
+}
+
+//Expand starts watching a directory in sparse mode, without what is below
+//it. It can be called before the monitor starts to configure the frontier
+func (m *monitor) Expand(dir string) error {
+	if m.sparse == nil {
+		return ErrNotSparse
+	}
+
+	dir, err := m.inTree(dir)
+	if err != nil {
+		return err
+	}
+
+	if !isDir(dir) {
+		return fmt.Errorf("Cannot expand '%s', it is not a directory", dir)
+	}
+
+	m.sparse.pin(dir)
+	if s, ok := m.self.(sparser); ok && !m.stopped {
+		return s.watchDir(dir)
+	}
+
+	return nil
+}
+
+//Collapse stops watching a directory in sparse mode, together
+//with all directories below it. The root cannot be collapsed
+func (m *monitor) Collapse(dir string) error {
+	if m.sparse == nil {
+		return ErrNotSparse
+	}
+
+	dir, err := m.inTree(dir)
+	if err != nil {
+		return err
+	}
+
+	if dir == m.dir {
+		return fmt.Errorf("Cannot collapse the root '%s'", dir)
+	}
+
+	dropped := m.sparse.drop(dir)
+	if s, ok := m.self.(sparser); ok && !m.stopped {
+		for _, path := range dropped {
+			s.unwatchDir(path)
+		}
+	}
+
+	return nil
+}
+
+//with a budget, an event for an entry in a watched directory that is a directory
+//itself means that one is active: it is watched from now on, at the expense of
+//the least recently active ones if the budget is exhausted
+func (m *monitor) activate(ev DirEvent) {
+	mev, ok := ev.(*mevent)
+	if !ok || m.sparse == nil || m.sparse.budget == 0 || m.stopped {
+		return
+	}
+
+	m.sparse.touch(mev.dir)
+	if mev.name == "" {
+		return
+	}
+
+	path := filepath.Join(mev.dir, mev.name)
+	if m.sparse.has(path) || !isDir(path) {
+		return
+	}
+
+	if res, err := m.sel(m.dir, path); !res || err != nil {
+		return
+	}
+
+	evicted, ok := m.sparse.add(path)
+	s, watches := m.self.(sparser)
+	if !ok || !watches {
+		return
+	}
+
+	for _, dir := range evicted {
+		s.unwatchDir(dir)
+	}
+
+	err := s.watchDir(path)
+	if err != nil {
+		m.fail(fmt.Errorf("Failed to watch active directory '%s': %s", path, err))
+	}
+}
+
+//returns the path of a directory that is part of the tree as events have
+//it, the links on the way to it are resolved like those of the root
+func (m *monitor) inTree(dir string) (string, error) {
+	abs, err := resolveParent(dir)
+	if err != nil {
+		return "", fmt.Errorf("Failed to resolve path '%s': %s", dir, err)
+	}
+
+	//the root itself given through a link
+	if rdir, err := resolve(abs); err == nil && rdir == m.dir {
+		abs = m.dir
+	}
+
+	res, err := m.sel(m.dir, abs)
+	if err != nil {
+		return "", err
+	} else if !res {
+		return "", fmt.Errorf("Directory '%s' is not selected in the tree of '%s'", dir, m.dir)
+	}
+
+	return abs, nil
+}
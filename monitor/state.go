@@ -0,0 +1,251 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/timeglass/snow/snapshot"
+)
+
+//a token that doesn't belong to the history of the monitor, everything
+//may have changed since then and only a complete rescan can tell what
+var ErrTokenExpired = errors.New("The token is not known to the monitor")
+
+//what is persisted between runs: the listing of the tree and
+//when each directory last changed, which is what tokens refer to
+type state struct {
+	Epoch    string
+	Clock    uint64
+	Changed  map[string]uint64
+	Snapshot *snapshot.Snapshot
+}
+
+//see WithState()
+func (m *monitor) setState(path string) error {
+	if path != "" {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return fmt.Errorf("Failed to determine absolute path for '%s': %s", path, err)
+		}
+
+		path = abs
+	}
+
+	m.state = path
+	return nil
+}
+
+//Token returns an opaque token for the current moment, it can be passed
+//to Since() later on to learn what changed after it was taken
+func (m *monitor) Token() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return fmt.Sprintf("%s:%d", m.epoch, m.clock)
+}
+
+//Since returns the directories for which an event was emitted after the token
+//was taken, for a StormEvent that is the ancestor of all its directories. Tokens
+//of a previous run are only known when its state was persisted, see WithState()
+func (m *monitor) Since(token string) ([]string, error) {
+	i := strings.LastIndex(token, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("Invalid token '%s'", token)
+	}
+
+	clock, err := strconv.ParseUint(token[i+1:], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid token '%s': %s", token, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if token[:i] != m.epoch || clock > m.clock {
+		return nil, ErrTokenExpired
+	}
+
+	dirs := []string{}
+	for dir, c := range m.changed {
+		if c > clock {
+			dirs = append(dirs, dir)
+		}
+	}
+
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+//hands over an event and records its directory as changed
+func (m *monitor) send(ev DirEvent) {
+	m.mu.Lock()
+	m.clock++
+	m.changed[ev.Dir()] = m.clock
+	m.mu.Unlock()
+
+	m.events <- ev
+}
+
+//compares the tree with the state of the previous run, once the backend
+//watches it, and hands the directories that changed in the meantime to
+//throttle(). When the state cannot be used the whole tree might have
+//changed, that is reported as a change of the root under a new epoch
+func (m *monitor) replay() {
+	if m.offline == nil {
+		return
+	}
+
+	dirs := []string{}
+	snap, err := m.load()
+	if err == nil && snap != nil {
+		dirs, err = m.compare(snap)
+	}
+
+	if err != nil {
+		m.mu.Lock()
+		m.epoch = newEpoch()
+		m.clock = 0
+		m.changed = map[string]uint64{}
+		m.mu.Unlock()
+		dirs = []string{m.dir}
+	}
+
+	m.offline <- dirs
+}
+
+//reads the state of the previous run, if there is one
+func (m *monitor) load() (*snapshot.Snapshot, error) {
+	data, err := ioutil.ReadFile(m.state)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to read state '%s': %s", m.state, err)
+	}
+
+	st := &state{}
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(st)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode state '%s': %s", m.state, err)
+	}
+
+	m.mu.Lock()
+	m.epoch = st.Epoch
+	m.clock = st.Clock
+	m.changed = st.Changed
+	if m.changed == nil {
+		m.changed = map[string]uint64{}
+	}
+	m.mu.Unlock()
+
+	if st.Snapshot == nil {
+		st.Snapshot = snapshot.New()
+	}
+
+	st.Snapshot.HashLimit = m.hashLimit
+	return st.Snapshot, nil
+}
+
+//returns the selected directories of which the listing differs from the snapshot,
+//removed directories show up as a change of the directory they were in
+func (m *monitor) compare(snap *snapshot.Snapshot) ([]string, error) {
+	changed := []string{}
+	err := m.walkSelected(m.dir, func(dir string) error {
+		d, err := snap.Diff(dir)
+		if err != nil {
+			return err
+		}
+
+		if !d.Empty() {
+			changed = append(changed, dir)
+		}
+
+		return nil
+	})
+
+	return changed, err
+}
+
+//persists the listing of the tree and the history of tokens for the next run,
+//the state file is replaced such that it is never partial. A root that is gone
+//has nothing to persist, the state of the previous run is kept in that case
+func (m *monitor) save() error {
+	if m.state == "" || !isDir(m.dir) {
+		return nil
+	}
+
+	snap := snapshot.New()
+	snap.HashLimit = m.hashLimit
+	err := m.walkSelected(m.dir, snap.Take)
+	if err != nil {
+		return fmt.Errorf("Failed to list '%s' for the state: %s", m.dir, err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	m.mu.Lock()
+	err = gob.NewEncoder(buf).Encode(&state{m.epoch, m.clock, m.changed, snap})
+	m.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("Failed to encode state: %s", err)
+	}
+
+	tmp := m.state + ".tmp"
+	err = ioutil.WriteFile(tmp, buf.Bytes(), 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to write state '%s': %s", tmp, err)
+	}
+
+	err = os.Rename(tmp, m.state)
+	if err != nil {
+		return fmt.Errorf("Failed to replace state '%s': %s", m.state, err)
+	}
+
+	return nil
+}
+
+//backends that follow symlinks or stop at the file system of the
+//root walk the tree themselves, see walkSelected()
+type treeWalker interface {
+	walkTree(root string, fn filepath.WalkFunc) error
+}
+
+//calls fn for every selected directory in the tree below root, that
+//the backend would watch: it crosses into the same symlinked directories
+//and stops at the same mount points
+func (m *monitor) walkSelected(root string, fn func(dir string) error) error {
+	walk := filepath.Walk
+	if w, ok := m.self.(treeWalker); ok {
+		walk = w.walkTree
+	}
+
+	return walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		if !fi.IsDir() {
+			return nil
+		}
+
+		if res, err := m.IsSelected(path); err != nil || !res {
+			return filepath.SkipDir
+		}
+
+		return fn(path)
+	})
+}
+
+//tokens of different epochs have nothing in common
+func newEpoch() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 36)
+}
@@ -0,0 +1,96 @@
+package monitor
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+//a storm event
+type sevent struct {
+	dir   string
+	count int
+}
+
+func (s *sevent) Dir() string { return s.dir }
+func (s *sevent) Count() int  { return s.count }
+
+//keeps track of the distinct directories that changed
+//within a window to detect when they start storming
+type storm struct {
+	threshold int
+	window    time.Duration
+	recent    map[string]time.Time
+	dirs      map[string]struct{}
+}
+
+func newStorm(threshold int, window time.Duration) *storm {
+	return &storm{
+		threshold: threshold,
+		window:    window,
+		recent:    map[string]time.Time{},
+	}
+}
+
+//add records a changed directory and returns true if it
+//was swallowed because the directories are storming
+func (s *storm) add(dir string, now time.Time) bool {
+	if s.dirs != nil {
+		s.dirs[dir] = struct{}{}
+		return true
+	}
+
+	for d, t := range s.recent {
+		if now.Sub(t) > s.window {
+			delete(s.recent, d)
+		}
+	}
+
+	s.recent[dir] = now
+	if len(s.recent) <= s.threshold {
+		return false
+	}
+
+	s.dirs = map[string]struct{}{}
+	for d := range s.recent {
+		s.dirs[d] = struct{}{}
+	}
+
+	return true
+}
+
+//end calms the storm and returns a single event for the
+//lowest common ancestor of all directories it swallowed
+func (s *storm) end() DirEvent {
+	dirs := []string{}
+	for d := range s.dirs {
+		dirs = append(dirs, d)
+	}
+
+	sort.Strings(dirs)
+	s.dirs = nil
+	s.recent = map[string]time.Time{}
+	return &sevent{ancestor(dirs), len(dirs)}
+}
+
+//returns the lowest common ancestor of the given directories
+func ancestor(dirs []string) string {
+	if len(dirs) == 0 {
+		return ""
+	}
+
+	anc := dirs[0]
+	for _, dir := range dirs[1:] {
+		for anc != dir && !strings.HasPrefix(dir, anc+string(filepath.Separator)) {
+			parent := filepath.Dir(anc)
+			if parent == anc {
+				break
+			}
+
+			anc = parent
+		}
+	}
+
+	return anc
+}
@@ -1,13 +1,18 @@
 package monitor
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"path/filepath"
 	"strings"
 	"time"
 )
 
 var ErrAlreadyStarted = errors.New("The monitor is already running")
 var ErrAlreadyStopped = errors.New("The monitor is already not running")
+var ErrAlreadyPaused = errors.New("The monitor is already paused")
+var ErrNotPaused = errors.New("The monitor is not paused")
 
 //Selectors allows monitoring to occure on something else then
 //the complete subtree
@@ -34,16 +39,102 @@ type DirEvent interface {
 	Dir() string
 }
 
+//Op describes kinds of changes to entries in a directory
+type Op uint32
+
+const (
+	Create Op = 1 << iota
+	Write
+	Remove
+	Rename
+	Attrib //permissions, ownership, extended attributes and timestamps
+	Access //reading and opening, also by the monitor itself, see WithOps()
+)
+
+//Events of backends that know what kind of change caused them
+//implement OpEvent, Op() returns the kind of that change
+type OpEvent interface {
+	DirEvent
+	Op() Op
+}
+
+//Events of backends that know what entry in the directory caused them
+//implement EntryEvent, Name() returns its name or is empty when the
+//directory itself changed. In write completion mode an event with the
+//name of a file and a Write, Rename or Create op reports it complete
+type EntryEvent interface {
+	DirEvent
+	Name() string
+}
+
+//Is emitted in storm mode instead of individual events when many
+//directories changed at once, Count() returns how many it replaces
+type StormEvent interface {
+	DirEvent
+	Count() int
+}
+
+//Is emitted when a file system is mounted or unmounted at a directory
+//inside the tree, Mounted() tells which of the two happend
+type MountEvent interface {
+	DirEvent
+	Mounted() bool
+}
+
+//Is emitted by monitors of a single file, see NewFile(). Dir() is the
+//directory the file is in and Path() the path it was watched by
+type FileEvent interface {
+	DirEvent
+	Path() string
+}
+
+//What happend to the root directory
+type Reason int
+
+const (
+	RootRemoved Reason = iota + 1
+	RootRenamed
+	RootUnmounted
+	RootCreated //a missing root appeared, see WithPersistentRoot() and WithWaitForRoot()
+)
+
+//Is emitted when the root directory itself is removed, renamed or unmounted,
+//it is the last event before the monitor stops. Reason() tells what happend
+type RootEvent interface {
+	DirEvent
+	Reason() Reason
+}
+
 type M interface {
 	CanEmit(path string) bool
 	Start() (chan DirEvent, error)
 	Stop() error
+	Flush(ctx context.Context) error
+	Pause() error
+	Resume(discard bool) error
+	Suppress(paths []string, fn func() error) error
+	WaitQuiet(ctx context.Context, d time.Duration) ([]string, error)
+	Token() string
+	Since(token string) ([]string, error)
+	Discrepancies() uint64
+	Expand(dir string) error
+	Collapse(dir string) error
 	Events() chan DirEvent
 	Errors() chan error
 	Dir() string
 }
 
 func New(dir string, sel Selector, latency time.Duration) (M, error) {
+	_, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to eval symlink for '%s': %s", dir, err)
+	}
+
+	return create(dir, sel, latency)
+}
+
+//creates the monitor for the backend, the root might not exist yet
+func create(dir string, sel Selector, latency time.Duration) (M, error) {
 	if sel == nil {
 		sel = Recursive
 	}
@@ -57,5 +148,6 @@ func New(dir string, sel Selector, latency time.Duration) (M, error) {
 		return nil, err
 	}
 
+	m.self = m
 	return m, nil
 }
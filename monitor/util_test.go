@@ -1,8 +1,8 @@
 package monitor
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -49,10 +49,10 @@ func setupTestDir(t *testing.T) string {
 	return filepath.Join(tdir, "workspace")
 }
 
-func setupTestDirMonitor(t *testing.T, sel Selector) M {
+func setupTestDirMonitor(t *testing.T, sel Selector, opts ...Option) M {
 	tdir := setupTestDir(t)
 
-	m, err := New(tdir, sel, Latency)
+	m, err := NewWithOptions(tdir, append([]Option{WithSelector(sel), WithLatency(Latency)}, opts...)...)
 	if err != nil {
 		t.Fatalf("Failed to create monitor: %s", err)
 	}
@@ -60,10 +60,36 @@ func setupTestDirMonitor(t *testing.T, sel Selector) M {
 	return m
 }
 
+//creates the test directory and returns a path to it through a symlink
+func setupLinkedTestDir(t *testing.T) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("Creating symlinks requires privileges on windows")
+	}
+
+	tdir := setupTestDir(t)
+	link := filepath.Join(filepath.Dir(tdir), "linked_workspace")
+	err := os.Symlink(tdir, link)
+	if err != nil {
+		t.Fatalf("Failed to create symlink: %s", err)
+	}
+
+	return link
+}
+
 func doSettle() {
 	<-time.After(Latency + SettleTime)
 }
 
+func doFlush(t *testing.T, m M) {
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+
+	err := m.Flush(ctx)
+	if err != nil {
+		t.Fatalf("Failed to flush: %s", err)
+	}
+}
+
 func doMove(t *testing.T, m M, parts ...string) {
 	from := []string{m.Dir()}
 	to := []string{m.Dir()}
@@ -154,6 +180,29 @@ func waitForNEvents(t *testing.T, m M, min, max int) chan *results {
 	return done
 }
 
+//skips events until one for the root arrives
+func assertRootEvent(t *testing.T, m M, reason Reason) {
+	for {
+		select {
+		case ev := <-m.Events():
+			rev, ok := ev.(RootEvent)
+			if !ok {
+				continue
+			}
+
+			if rev.Dir() != m.Dir() || rev.Reason() != reason {
+				t.Fatalf("Expected root event with reason %d for '%s', got: %d for '%s'", reason, m.Dir(), rev.Reason(), rev.Dir())
+			}
+
+			return
+		case err := <-m.Errors():
+			t.Fatalf("Expected root event with reason %d, got error: %s", reason, err)
+		case <-time.After(Timeout):
+			t.Fatalf("Timed out waiting for root event with reason %d", reason)
+		}
+	}
+}
+
 func assertAtLeast(t *testing.T, evs []DirEvent, n int, dir string) {
 	fi1, err := os.Stat(dir)
 	if err != nil {
@@ -249,7 +298,7 @@ func assertNoErrors(t *testing.T, errs []error) {
 func assertShutdown(t *testing.T, m M) {
 	err := m.Stop()
 	if err != nil && err != ErrAlreadyStopped {
-		t.Fatalf(fmt.Sprint("Failed to stop: %s"), err)
+		t.Fatalf("Failed to stop: %s", err)
 	}
 
 	//wait for the garbage collector
@@ -284,3 +333,14 @@ func assertShutdown(t *testing.T, m M) {
 		t.Fatalf("Nr of allocated resources (descriptors/handles) now changed %d times, only %d was deemed acceptalbe for OS %s", NrOfResourceChanges, acceptable, runtime.GOOS)
 	}
 }
+
+func assertSince(t *testing.T, m M, token string, dirs ...string) {
+	changed, err := m.Since(token)
+	if err != nil {
+		t.Fatalf("Failed to ask what changed since '%s': %s", token, err)
+	}
+
+	if strings.Join(changed, ",") != strings.Join(dirs, ",") {
+		t.Fatalf("Expected %v to have changed since '%s', got: %v", dirs, token, changed)
+	}
+}
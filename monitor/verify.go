@@ -0,0 +1,239 @@
+package monitor
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/timeglass/snow/snapshot"
+)
+
+//verifier periodically compares the listings of the tree with the previous pass,
+//directories that changed without the backend noticing are reported after all. It
+//is a safety net for events that the kernel dropped or never sent
+type verifier struct {
+	m        *monitor
+	interval time.Duration
+	adaptive bool
+	snap     *snapshot.Snapshot
+	dirs     map[string]struct{}
+	suspects map[string]uint64
+	stop     chan struct{}
+}
+
+func newVerifier(m *monitor, interval time.Duration, adaptive bool) *verifier {
+	return &verifier{
+		m:        m,
+		interval: interval,
+		adaptive: adaptive,
+		snap:     snapshot.New(),
+		dirs:     map[string]struct{}{},
+		suspects: map[string]uint64{},
+		stop:     make(chan struct{}),
+	}
+}
+
+//see WithVerify()
+func (m *monitor) setVerify(interval time.Duration, adaptive bool) error {
+	if interval < 0 {
+		return fmt.Errorf("Verify interval cannot be negative, got: %s", interval)
+	}
+
+	m.verifyEvery = interval
+	m.adaptive = adaptive
+	return nil
+}
+
+//Discrepancies returns how many times a directory changed without the
+//backend noticing, as caught by verification. See WithVerify()
+func (m *monitor) Discrepancies() uint64 {
+	return atomic.LoadUint64(&m.missed)
+}
+
+//every event that comes in from the backend, before anything
+//filters it, tells that the backend noticed a change in the directory
+func (m *monitor) notice(dir string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.notices++
+	m.noticed[dir] = m.notices
+}
+
+func (m *monitor) noticeClock() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.notices
+}
+
+func (m *monitor) noticedSince(dir string, clock uint64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.noticed[dir] > clock
+}
+
+func (v *verifier) close() {
+	close(v.stop)
+}
+
+func (v *verifier) run() {
+	lowerPriority()
+
+	since := v.m.noticeClock()
+	err := v.m.walkSelected(v.m.dir, func(dir string) error {
+		v.dirs[dir] = struct{}{}
+		return v.snap.Take(dir)
+	})
+
+	if err != nil {
+		v.fail(err)
+	}
+
+	next := v.interval
+	for {
+		select {
+		case <-time.After(next):
+		case <-v.stop:
+			return
+		}
+
+		began := time.Now()
+		missed := v.confirm()
+		clock := v.m.noticeClock()
+		err := v.pass(since)
+		since = clock
+
+		for _, dir := range missed {
+			atomic.AddUint64(&v.m.missed, 1)
+			select {
+			case v.m.unthrottled <- &mevent{dir, "", 0}:
+			case <-v.stop:
+				return
+			}
+		}
+
+		if err != nil {
+			v.fail(err)
+		}
+
+		if v.adaptive {
+			next = v.adapt(next, len(missed), time.Since(began))
+		}
+	}
+}
+
+//returns the suspects of the previous pass that the backend still didn't
+//notice, by now the events for them would have come through
+func (v *verifier) confirm() []string {
+	missed := []string{}
+	for dir, clock := range v.suspects {
+		if !v.m.noticedSince(dir, clock) {
+			missed = append(missed, dir)
+		}
+	}
+
+	v.suspects = map[string]uint64{}
+	sort.Strings(missed)
+	return missed
+}
+
+//compares every directory with its listing of the previous pass. Changes that the
+//backend didn't notice since then are suspects, their events might still be underway
+func (v *verifier) pass(since uint64) error {
+	seen := map[string]struct{}{}
+	err := v.m.walkSelected(v.m.dir, func(dir string) error {
+		seen[dir] = struct{}{}
+		d, err := v.snap.Diff(dir)
+		if err != nil {
+			return err
+		}
+
+		if v.isObservable(d) && !v.m.noticedSince(dir, since) {
+			v.suspects[dir] = since
+		}
+
+		return nil
+	})
+
+	//removed directories show up as a change of the directory they were in
+	for dir := range v.dirs {
+		if _, ok := seen[dir]; !ok {
+			v.snap.Forget(dir)
+		}
+	}
+
+	v.dirs = seen
+	return err
+}
+
+//whether the diff holds changes the monitor would have emitted an event for,
+//cookies are never emitted and neither are editor files or ignored kinds of changes
+func (v *verifier) isObservable(d *snapshot.Diff) bool {
+	observable := func(e snapshot.Entry, op Op) bool {
+		if strings.HasPrefix(e.Name, cookiePrefix) || (v.m.editors && isEditorTemp(e.Name)) {
+			return false
+		}
+
+		return op&v.m.ops != 0
+	}
+
+	for _, e := range d.Created {
+		if observable(e, Create) {
+			return true
+		}
+	}
+
+	for _, e := range d.Removed {
+		if observable(e, Remove) {
+			return true
+		}
+	}
+
+	for _, e := range d.Modified {
+		if observable(e, Write|Attrib) {
+			return true
+		}
+	}
+
+	for _, r := range d.Renamed {
+		if observable(r.From, Rename) || observable(r.To, Rename) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//the next pass comes sooner after one that caught something and later after one that
+//didn't, within bounds and such that walking takes at most a tenth of the time
+func (v *verifier) adapt(next time.Duration, missed int, took time.Duration) time.Duration {
+	if missed > 0 {
+		next /= 2
+	} else {
+		next *= 2
+	}
+
+	if next < v.interval/8 {
+		next = v.interval / 8
+	}
+
+	if next > v.interval*8 {
+		next = v.interval * 8
+	}
+
+	if next < took*10 {
+		next = took * 10
+	}
+
+	return next
+}
+
+//errors are not reported anymore once stopped
+func (v *verifier) fail(err error) {
+	select {
+	case <-v.stop:
+	default:
+		v.m.fail(fmt.Errorf("Failed to verify '%s': %s", v.m.dir, err))
+	}
+}
@@ -0,0 +1,241 @@
+//Package reload keeps a value decoded from a file up to date, such
+//as the configuration of a service that is changed while it runs
+package reload
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/timeglass/snow/monitor"
+)
+
+//the file changed while it was read, a writer is not done with it yet
+var errUnsettled = errors.New("The file changed while it was read")
+
+//Watcher holds the last good value of a file and delivers new ones
+type Watcher[T any] struct {
+	m        monitor.M
+	path     string
+	debounce time.Duration
+	decode   func(data []byte) (T, error)
+	validate func(v T) error
+	current  T
+	data     []byte
+	values   chan T
+	errors   chan error
+	stop     chan struct{}
+	done     chan struct{}
+	mu       sync.Mutex
+}
+
+//Watch decodes the file at path and validates the result, which has to succeed.
+//After that, once the file stopped changing for the debounce duration, it is read
+//and decoded again. Values that are different and valid are delivered on Values(),
+//any failure to read, decode or validate on Errors() while the last good value is
+//kept. Neither has to be read from, only the latest value and error are held on to
+//until they are. The file may be replaced atomically, see monitor.NewFile(). Validate
+//is optional and a debounce of 0 defaults to 50ms
+func Watch[T any](path string, debounce time.Duration, decode func(data []byte) (T, error), validate func(v T) error) (*Watcher[T], error) {
+	if decode == nil {
+		return nil, fmt.Errorf("A decode function is required to watch '%s'", path)
+	}
+
+	if debounce == 0 {
+		debounce = time.Millisecond * 50
+	}
+
+	m, err := monitor.NewFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Watcher[T]{
+		m:        m,
+		path:     path,
+		debounce: debounce,
+		decode:   decode,
+		validate: validate,
+		values:   make(chan T, 1),
+		errors:   make(chan error, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	//changes made while loading are not missed
+	_, err = m.Start()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to watch '%s': %s", path, err)
+	}
+
+	data, v, err := w.load()
+	if err != nil {
+		m.Stop()
+		return nil, fmt.Errorf("Failed to load '%s': %s", path, err)
+	}
+
+	w.data = data
+	w.current = v
+	go w.run()
+	return w, nil
+}
+
+//Current returns the last good value
+func (w *Watcher[T]) Current() T {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.current
+}
+
+//Values delivers new good values, when it isn't read from
+//a value that wasn't received yet is replaced by a newer one
+func (w *Watcher[T]) Values() <-chan T {
+	return w.values
+}
+
+//Errors delivers failures to load a new value, when it isn't read
+//from an error that wasn't received yet is replaced by a newer one
+func (w *Watcher[T]) Errors() <-chan error {
+	return w.errors
+}
+
+//Stop ends the watching, the last good value remains available
+func (w *Watcher[T]) Stop() error {
+	select {
+	case <-w.stop:
+		return monitor.ErrAlreadyStopped
+	default:
+	}
+
+	close(w.stop)
+	<-w.done
+
+	//the file monitor no longer hands over events once it stops
+	err := w.m.Stop()
+	if err == monitor.ErrAlreadyStopped {
+		return nil
+	}
+
+	return err
+}
+
+func (w *Watcher[T]) run() {
+	defer close(w.done)
+
+	var settle <-chan time.Time
+	for {
+		select {
+		case ev := <-w.m.Events():
+			if _, ok := ev.(monitor.RootEvent); ok {
+				w.fail(fmt.Errorf("Stopped watching '%s', its directory is gone", w.path))
+				return
+			}
+
+			settle = time.After(w.debounce)
+		case err := <-w.m.Errors():
+			w.fail(err)
+		case <-settle:
+			settle = nil
+			err := w.reload()
+			if err == errUnsettled {
+				settle = time.After(w.debounce)
+			} else if err != nil {
+				w.fail(fmt.Errorf("Failed to reload '%s': %s", w.path, err))
+			}
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+//loads the file and hands over the value when it is new
+func (w *Watcher[T]) reload() error {
+	data, v, err := w.load()
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(data, w.data) {
+		return nil
+	}
+
+	w.mu.Lock()
+	w.data = data
+	w.current = v
+	w.mu.Unlock()
+
+	//the run loop is the only sender, after taking out what is
+	//still buffered there always is room for the latest
+	select {
+	case <-w.values:
+	default:
+	}
+
+	w.values <- v
+	return nil
+}
+
+//reads, decodes and validates the file
+func (w *Watcher[T]) load() ([]byte, T, error) {
+	var v T
+	data, err := w.read()
+	if err != nil {
+		return nil, v, err
+	}
+
+	v, err = w.decode(data)
+	if err != nil {
+		return nil, v, fmt.Errorf("Failed to decode: %s", err)
+	}
+
+	if w.validate != nil {
+		err = w.validate(v)
+		if err != nil {
+			return nil, v, fmt.Errorf("Invalid: %s", err)
+		}
+	}
+
+	return data, v, nil
+}
+
+//reads the file and checks that it didn't change while doing so, a
+//writer that is not done yet would otherwise hand us part of it
+func (w *Watcher[T]) read() ([]byte, error) {
+	before, err := os.Stat(w.path)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(w.path)
+	if err != nil {
+		return nil, err
+	}
+
+	after, err := os.Stat(w.path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !os.SameFile(before, after) ||
+		before.Size() != after.Size() ||
+		!before.ModTime().Equal(after.ModTime()) ||
+		int64(len(data)) != after.Size() {
+		return nil, errUnsettled
+	}
+
+	return data, nil
+}
+
+//hands over an error like reload() does with values
+func (w *Watcher[T]) fail(err error) {
+	select {
+	case <-w.errors:
+	default:
+	}
+
+	w.errors <- err
+}
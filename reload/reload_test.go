@@ -0,0 +1,224 @@
+package reload
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var Debounce = time.Millisecond * 20
+var Timeout = time.Millisecond * 200
+
+type config struct {
+	Workers int
+}
+
+func decodeConfig(data []byte) (config, error) {
+	var c config
+	err := json.Unmarshal(data, &c)
+	return c, err
+}
+
+func validateConfig(c config) error {
+	if c.Workers < 1 {
+		return fmt.Errorf("Expected at least 1 worker, got: %d", c.Workers)
+	}
+
+	return nil
+}
+
+func setupTestWatcher(t *testing.T, data string) (*Watcher[config], string) {
+	tdir, err := ioutil.TempDir("", ".timeglass_reload")
+	if err != nil {
+		t.Fatalf("Failed to create test directory: %s", err)
+	}
+
+	path := filepath.Join(tdir, "config.json")
+	doWriteFile(t, path, data)
+
+	w, err := Watch(path, Debounce, decodeConfig, validateConfig)
+	if err != nil {
+		t.Fatalf("Failed to watch '%s': %s", path, err)
+	}
+
+	return w, path
+}
+
+func doWriteFile(t *testing.T, path, data string) {
+	err := ioutil.WriteFile(path, []byte(data), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write file '%s': '%s'", path, err)
+	}
+}
+
+func assertValue(t *testing.T, w *Watcher[config], workers int) {
+	select {
+	case c := <-w.Values():
+		if c.Workers != workers {
+			t.Fatalf("Expected value with %d workers, got: %d", workers, c.Workers)
+		}
+	case err := <-w.Errors():
+		t.Fatalf("Expected value with %d workers, got error: %s", workers, err)
+	case <-time.After(Timeout):
+		t.Fatalf("Timed out waiting for value with %d workers", workers)
+	}
+
+	if w.Current().Workers != workers {
+		t.Fatalf("Expected current value to have %d workers, got: %d", workers, w.Current().Workers)
+	}
+}
+
+func assertError(t *testing.T, w *Watcher[config]) {
+	select {
+	case c := <-w.Values():
+		t.Fatalf("Expected an error, got value: %v", c)
+	case <-w.Errors():
+	case <-time.After(Timeout):
+		t.Fatalf("Timed out waiting for an error")
+	}
+}
+
+func assertNothing(t *testing.T, w *Watcher[config]) {
+	select {
+	case c := <-w.Values():
+		t.Fatalf("Expected nothing, got value: %v", c)
+	case err := <-w.Errors():
+		t.Fatalf("Expected nothing, got error: %s", err)
+	case <-time.After(Timeout):
+	}
+}
+
+func assertStop(t *testing.T, w *Watcher[config]) {
+	err := w.Stop()
+	if err != nil {
+		t.Fatalf("Failed to stop: %s", err)
+	}
+}
+
+func TestInitialValue(t *testing.T) {
+	w, _ := setupTestWatcher(t, `{"Workers": 2}`)
+	if w.Current().Workers != 2 {
+		t.Fatalf("Expected initial value with 2 workers, got: %d", w.Current().Workers)
+	}
+
+	assertStop(t, w)
+}
+
+func TestInitialInvalid(t *testing.T) {
+	tdir, err := ioutil.TempDir("", ".timeglass_reload")
+	if err != nil {
+		t.Fatalf("Failed to create test directory: %s", err)
+	}
+
+	path := filepath.Join(tdir, "config.json")
+	doWriteFile(t, path, `{"Workers": 0}`)
+	_, err = Watch(path, Debounce, decodeConfig, validateConfig)
+	if err == nil {
+		t.Fatalf("Expected an invalid initial value to fail")
+	}
+}
+
+func TestReload(t *testing.T) {
+	w, path := setupTestWatcher(t, `{"Workers": 2}`)
+	doWriteFile(t, path, `{"Workers": 3}`)
+	assertValue(t, w, 3)
+	assertStop(t, w)
+}
+
+func TestReloadDebounced(t *testing.T) {
+	w, path := setupTestWatcher(t, `{"Workers": 2}`)
+
+	//a writer that is slow, only the end result counts
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open '%s': %s", path, err)
+	}
+
+	for _, part := range []string{`{"Wor`, `kers"`, `: 4}`} {
+		f.WriteString(part)
+		<-time.After(Debounce / 4)
+	}
+
+	f.Close()
+	assertValue(t, w, 4)
+	assertNothing(t, w)
+	assertStop(t, w)
+}
+
+func TestReloadInvalidKeepsLastGood(t *testing.T) {
+	w, path := setupTestWatcher(t, `{"Workers": 2}`)
+	doWriteFile(t, path, `{"Workers": -1}`)
+	assertError(t, w)
+	if w.Current().Workers != 2 {
+		t.Fatalf("Expected last good value with 2 workers, got: %d", w.Current().Workers)
+	}
+
+	doWriteFile(t, path, `{"Workers`)
+	assertError(t, w)
+
+	doWriteFile(t, path, `{"Workers": 5}`)
+	assertValue(t, w, 5)
+	assertStop(t, w)
+}
+
+func TestReloadErrorsUnread(t *testing.T) {
+	w, path := setupTestWatcher(t, `{"Workers": 2}`)
+	doWriteFile(t, path, `{"Workers": -1}`)
+	<-time.After(Debounce * 4)
+
+	//nobody reads the error, the next good value still comes through
+	doWriteFile(t, path, `{"Workers": 5}`)
+	select {
+	case c := <-w.Values():
+		if c.Workers != 5 {
+			t.Fatalf("Expected value with 5 workers, got: %d", c.Workers)
+		}
+	case <-time.After(Timeout):
+		t.Fatalf("Timed out waiting for value with 5 workers")
+	}
+
+	if w.Current().Workers != 5 {
+		t.Fatalf("Expected current value to have 5 workers, got: %d", w.Current().Workers)
+	}
+
+	assertStop(t, w)
+}
+
+func TestReloadValuesUnread(t *testing.T) {
+	w, path := setupTestWatcher(t, `{"Workers": 2}`)
+	doWriteFile(t, path, `{"Workers": 3}`)
+	<-time.After(Debounce * 4)
+
+	//nobody reads the values, the current one is still kept up to date
+	doWriteFile(t, path, `{"Workers": 4}`)
+	<-time.After(Debounce * 4)
+	if w.Current().Workers != 4 {
+		t.Fatalf("Expected current value to have 4 workers, got: %d", w.Current().Workers)
+	}
+
+	assertValue(t, w, 4)
+	assertStop(t, w)
+}
+
+func TestReloadSameValue(t *testing.T) {
+	w, path := setupTestWatcher(t, `{"Workers": 2}`)
+	doWriteFile(t, path, `{"Workers": 2}`)
+	assertNothing(t, w)
+	assertStop(t, w)
+}
+
+func TestReloadAtomicReplace(t *testing.T) {
+	w, path := setupTestWatcher(t, `{"Workers": 2}`)
+	doWriteFile(t, path+".tmp", `{"Workers": 6}`)
+	err := os.Rename(path+".tmp", path)
+	if err != nil {
+		t.Fatalf("Failed to replace '%s': %s", path, err)
+	}
+
+	assertValue(t, w, 6)
+	assertStop(t, w)
+}
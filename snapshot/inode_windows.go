@@ -0,0 +1,13 @@
+// +build windows
+
+package snapshot
+
+import (
+	"os"
+)
+
+//the file index is not part of the information returned by
+//ReadDir on windows, renames are reported as removal and creation
+func inode(fi os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,287 @@
+//Package snapshot keeps a listing of directories such that the
+//directory events of a monitor can be turned into precise changes
+package snapshot
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+//Entry describes a single file or directory in a listing
+type Entry struct {
+	Name    string
+	Mode    os.FileMode
+	Size    int64
+	ModTime time.Time
+	Inode   uint64
+	Hash    string
+}
+
+//an entry is modified when anything but its name changed, if the
+//content of both is hashed only the content and mode are compared. The
+//size and modtime of directories change with what is inside of them,
+//which is a change in that directory and not in this one
+func (e Entry) modified(o Entry) bool {
+	if e.Mode.IsDir() && o.Mode.IsDir() {
+		return e.Mode != o.Mode || e.Inode != o.Inode
+	}
+
+	if e.Hash != "" && o.Hash != "" {
+		return e.Mode != o.Mode || e.Hash != o.Hash
+	}
+
+	return e.Mode != o.Mode || e.Size != o.Size || !e.ModTime.Equal(o.ModTime) || e.Inode != o.Inode
+}
+
+//Rename is an entry that was found under another name
+type Rename struct {
+	From Entry
+	To   Entry
+}
+
+//Diff describes what changed in a directory since it was last seen
+type Diff struct {
+	Dir      string
+	Created  []Entry
+	Removed  []Entry
+	Modified []Entry
+	Renamed  []Rename
+}
+
+//Empty returns whether nothing changed at all
+func (d *Diff) Empty() bool {
+	return len(d.Created) == 0 && len(d.Removed) == 0 && len(d.Modified) == 0 && len(d.Renamed) == 0
+}
+
+//Snapshot holds the last seen listing of each directory, if HashLimit is
+//set the content of regular files up to that size is hashed such that
+//rewriting a file with identical content is not reported as a modification
+type Snapshot struct {
+	HashLimit int64
+	dirs      map[string]map[string]Entry
+	sync.Mutex
+}
+
+func New() *Snapshot {
+	return &Snapshot{
+		dirs: map[string]map[string]Entry{},
+	}
+}
+
+//List reads the current listing of a directory, a directory
+//that doesn't exist (anymore) has an empty listing
+func List(dir string) (map[string]Entry, error) {
+	list := map[string]Entry{}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return list, nil
+		}
+
+		return nil, fmt.Errorf("Failed to read dir '%s': %s", dir, err)
+	}
+
+	for _, fi := range fis {
+		list[fi.Name()] = Entry{
+			Name:    fi.Name(),
+			Mode:    fi.Mode(),
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+			Inode:   inode(fi),
+		}
+	}
+
+	return list, nil
+}
+
+//hash the content of regular files in the listing, files that have the same size,
+//modtime and inode as in the previous listing are assumed to be unchanged
+func (s *Snapshot) hash(dir string, prev, list map[string]Entry) error {
+	for name, e := range list {
+		if !e.Mode.IsRegular() || e.Size > s.HashLimit {
+			continue
+		}
+
+		if p, ok := prev[name]; ok && p.Hash != "" && p.Size == e.Size && p.ModTime.Equal(e.ModTime) && p.Inode == e.Inode {
+			e.Hash = p.Hash
+			list[name] = e
+			continue
+		}
+
+		h, err := hashFile(filepath.Join(dir, name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			return err
+		}
+
+		e.Hash = h
+		list[name] = e
+	}
+
+	return nil
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close()
+	h := sha1.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", fmt.Errorf("Failed to hash '%s': %s", path, err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+//list the directory and hash it if asked to
+func (s *Snapshot) list(dir string) (map[string]Entry, error) {
+	list, err := List(dir)
+	if err != nil || s.HashLimit <= 0 {
+		return list, err
+	}
+
+	s.Lock()
+	prev := s.dirs[dir]
+	s.Unlock()
+
+	err = s.hash(dir, prev, list)
+	if err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+//Take records the current listing of a directory without comparing it
+func (s *Snapshot) Take(dir string) error {
+	list, err := s.list(dir)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.dirs[dir] = list
+	return nil
+}
+
+//Forget drops the listing of a directory
+func (s *Snapshot) Forget(dir string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.dirs, dir)
+}
+
+//MarshalBinary encodes the listings such that they can be persisted and
+//compared with the file system later on, the hash limit is not included
+func (s *Snapshot) MarshalBinary() ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	buf := bytes.NewBuffer(nil)
+	err := gob.NewEncoder(buf).Encode(s.dirs)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to encode snapshot: %s", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+//UnmarshalBinary replaces the listings with the ones that were encoded
+func (s *Snapshot) UnmarshalBinary(data []byte) error {
+	dirs := map[string]map[string]Entry{}
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&dirs)
+	if err != nil {
+		return fmt.Errorf("Failed to decode snapshot: %s", err)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.dirs = dirs
+	return nil
+}
+
+//Diff compares the current listing of a directory, typically the Dir() of a
+//monitor event, with the one that was last seen and remembers the current one. A
+//directory that wasn't seen before reports all its entries as created
+func (s *Snapshot) Diff(dir string) (*Diff, error) {
+	list, err := s.list(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	prev := s.dirs[dir]
+	if len(list) > 0 {
+		s.dirs[dir] = list
+	} else {
+		delete(s.dirs, dir)
+	}
+	s.Unlock()
+
+	return compare(dir, prev, list), nil
+}
+
+func compare(dir string, prev, list map[string]Entry) *Diff {
+	d := &Diff{Dir: dir}
+	created := map[uint64]Entry{}
+	for name, e := range list {
+		p, ok := prev[name]
+		if !ok {
+			if _, seen := created[e.Inode]; seen || e.Inode == 0 {
+				d.Created = append(d.Created, e)
+			} else {
+				created[e.Inode] = e
+			}
+		} else if e.modified(p) {
+			d.Modified = append(d.Modified, e)
+		}
+	}
+
+	//entries that disappeared but show up under another name
+	//with the same inode were renamed instead
+	for name, p := range prev {
+		if _, ok := list[name]; ok {
+			continue
+		}
+
+		if e, ok := created[p.Inode]; ok {
+			d.Renamed = append(d.Renamed, Rename{From: p, To: e})
+			delete(created, p.Inode)
+			continue
+		}
+
+		d.Removed = append(d.Removed, p)
+	}
+
+	for _, e := range created {
+		d.Created = append(d.Created, e)
+	}
+
+	sortEntries(d.Created)
+	sortEntries(d.Removed)
+	sortEntries(d.Modified)
+	sort.Slice(d.Renamed, func(i, j int) bool { return d.Renamed[i].To.Name < d.Renamed[j].To.Name })
+	return d
+}
+
+func sortEntries(es []Entry) {
+	sort.Slice(es, func(i, j int) bool { return es[i].Name < es[j].Name })
+}
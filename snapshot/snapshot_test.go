@@ -0,0 +1,258 @@
+package snapshot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func setupTestDir(t *testing.T) string {
+	tdir, err := ioutil.TempDir("", ".timeglass_snapshot")
+	if err != nil {
+		t.Fatalf("Failed to create test directory: %s", err)
+	}
+
+	for _, name := range []string{"file_1.md", "file_2.md", "file_3.md"} {
+		err = ioutil.WriteFile(filepath.Join(tdir, name), []byte("#foobar"), 0644)
+		if err != nil {
+			t.Fatalf("Failed to write test file '%s': %s", name, err)
+		}
+	}
+
+	return tdir
+}
+
+func assertEntries(t *testing.T, kind string, es []Entry, names ...string) {
+	if len(es) != len(names) {
+		t.Fatalf("Expected %d %s entries, got %d: %v", len(names), kind, len(es), es)
+	}
+
+	for i, e := range es {
+		if e.Name != names[i] {
+			t.Fatalf("Expected %s entry nr %d to be '%s', got: '%s'", kind, i+1, names[i], e.Name)
+		}
+	}
+}
+
+func TestDiffUnseenDir(t *testing.T) {
+	dir := setupTestDir(t)
+	defer os.RemoveAll(dir)
+
+	d, err := New().Diff(dir)
+	if err != nil {
+		t.Fatalf("Failed to diff: %s", err)
+	}
+
+	assertEntries(t, "created", d.Created, "file_1.md", "file_2.md", "file_3.md")
+}
+
+func TestDiffNothingChanged(t *testing.T) {
+	dir := setupTestDir(t)
+	defer os.RemoveAll(dir)
+
+	s := New()
+	err := s.Take(dir)
+	if err != nil {
+		t.Fatalf("Failed to take snapshot: %s", err)
+	}
+
+	d, err := s.Diff(dir)
+	if err != nil {
+		t.Fatalf("Failed to diff: %s", err)
+	}
+
+	if !d.Empty() {
+		t.Fatalf("Expected an empty diff, got: %+v", d)
+	}
+}
+
+func TestDiffChanges(t *testing.T) {
+	dir := setupTestDir(t)
+	defer os.RemoveAll(dir)
+
+	s := New()
+	err := s.Take(dir)
+	if err != nil {
+		t.Fatalf("Failed to take snapshot: %s", err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "file_4.md"), []byte("#foobar"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create file: %s", err)
+	}
+
+	err = os.Remove(filepath.Join(dir, "file_1.md"))
+	if err != nil {
+		t.Fatalf("Failed to remove file: %s", err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "file_2.md"), []byte("#foobar, #foobaz"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to modify file: %s", err)
+	}
+
+	err = os.Rename(filepath.Join(dir, "file_3.md"), filepath.Join(dir, "file_5.md"))
+	if err != nil {
+		t.Fatalf("Failed to rename file: %s", err)
+	}
+
+	d, err := s.Diff(dir)
+	if err != nil {
+		t.Fatalf("Failed to diff: %s", err)
+	}
+
+	assertEntries(t, "modified", d.Modified, "file_2.md")
+	if runtime.GOOS == "windows" {
+		assertEntries(t, "created", d.Created, "file_4.md", "file_5.md")
+		assertEntries(t, "removed", d.Removed, "file_1.md", "file_3.md")
+		return
+	}
+
+	assertEntries(t, "created", d.Created, "file_4.md")
+	assertEntries(t, "removed", d.Removed, "file_1.md")
+	if len(d.Renamed) != 1 || d.Renamed[0].From.Name != "file_3.md" || d.Renamed[0].To.Name != "file_5.md" {
+		t.Fatalf("Expected file_3.md to be renamed to file_5.md, got: %v", d.Renamed)
+	}
+
+	//the new listing is remembered
+	d, err = s.Diff(dir)
+	if err != nil {
+		t.Fatalf("Failed to diff: %s", err)
+	}
+
+	if !d.Empty() {
+		t.Fatalf("Expected an empty diff after the changes were seen, got: %+v", d)
+	}
+}
+
+func TestDiffSubdirContents(t *testing.T) {
+	dir := setupTestDir(t)
+	defer os.RemoveAll(dir)
+
+	err := os.Mkdir(filepath.Join(dir, "sub_dir"), 0755)
+	if err != nil {
+		t.Fatalf("Failed to create directory: %s", err)
+	}
+
+	s := New()
+	err = s.Take(dir)
+	if err != nil {
+		t.Fatalf("Failed to take snapshot: %s", err)
+	}
+
+	//what changes inside a directory is not a change of the directory itself
+	<-time.After(time.Millisecond * 10)
+	err = ioutil.WriteFile(filepath.Join(dir, "sub_dir", "file_4.md"), []byte("#foobar"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create file: %s", err)
+	}
+
+	d, err := s.Diff(dir)
+	if err != nil {
+		t.Fatalf("Failed to diff: %s", err)
+	}
+
+	if !d.Empty() {
+		t.Fatalf("Expected an empty diff, got: %+v", d)
+	}
+}
+
+func TestDiffRemovedDir(t *testing.T) {
+	dir := setupTestDir(t)
+
+	s := New()
+	err := s.Take(dir)
+	if err != nil {
+		t.Fatalf("Failed to take snapshot: %s", err)
+	}
+
+	err = os.RemoveAll(dir)
+	if err != nil {
+		t.Fatalf("Failed to remove test directory: %s", err)
+	}
+
+	d, err := s.Diff(dir)
+	if err != nil {
+		t.Fatalf("Failed to diff: %s", err)
+	}
+
+	assertEntries(t, "removed", d.Removed, "file_1.md", "file_2.md", "file_3.md")
+}
+
+func TestDiffSameContentHashed(t *testing.T) {
+	dir := setupTestDir(t)
+	defer os.RemoveAll(dir)
+
+	s := New()
+	s.HashLimit = 1024
+	err := s.Take(dir)
+	if err != nil {
+		t.Fatalf("Failed to take snapshot: %s", err)
+	}
+
+	path := filepath.Join(dir, "file_1.md")
+	err = os.Chtimes(path, time.Now(), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to touch file: %s", err)
+	}
+
+	d, err := s.Diff(dir)
+	if err != nil {
+		t.Fatalf("Failed to diff: %s", err)
+	}
+
+	if !d.Empty() {
+		t.Fatalf("Expected an empty diff for identical content, got: %+v", d)
+	}
+
+	err = ioutil.WriteFile(path, []byte("#foobaz"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to modify file: %s", err)
+	}
+
+	d, err = s.Diff(dir)
+	if err != nil {
+		t.Fatalf("Failed to diff: %s", err)
+	}
+
+	assertEntries(t, "modified", d.Modified, "file_1.md")
+}
+
+func TestDiffUnmarshaled(t *testing.T) {
+	dir := setupTestDir(t)
+	defer os.RemoveAll(dir)
+
+	s := New()
+	err := s.Take(dir)
+	if err != nil {
+		t.Fatalf("Failed to take snapshot: %s", err)
+	}
+
+	data, err := s.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Failed to marshal snapshot: %s", err)
+	}
+
+	err = os.Remove(filepath.Join(dir, "file_2.md"))
+	if err != nil {
+		t.Fatalf("Failed to remove test file: %s", err)
+	}
+
+	s = New()
+	err = s.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal snapshot: %s", err)
+	}
+
+	d, err := s.Diff(dir)
+	if err != nil {
+		t.Fatalf("Failed to diff: %s", err)
+	}
+
+	assertEntries(t, "created", d.Created)
+	assertEntries(t, "modified", d.Modified)
+	assertEntries(t, "removed", d.Removed, "file_2.md")
+}
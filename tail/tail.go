@@ -0,0 +1,407 @@
+//Package tail follows files that are appended to, such as logs, and
+//hands over every complete line that is written to them
+package tail
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/timeglass/snow/monitor"
+)
+
+//how much of the start of a file identifies it when resuming
+var headSize = int64(1024)
+
+//lines are no longer handed over
+var errStopped = errors.New("The tailer was stopped")
+
+//Line is a complete line that was appended to a file, Offset is
+//where the next line starts and what is resumed from
+type Line struct {
+	Path   string
+	Text   string
+	Offset int64
+}
+
+//where reading a file continues and what the file started with
+type offset struct {
+	Offset int64
+	Head   string
+}
+
+//a single file that is followed, file is what is read from which is
+//not necessarily what the path resolves to, after a rotation the old
+//file is read until its end first. Start is what the file started with
+//when it was read, up to the size of its head
+type follower struct {
+	m       monitor.M
+	path    string
+	file    *os.File
+	fi      os.FileInfo
+	offset  int64
+	start   []byte
+	partial []byte
+	resumed bool
+}
+
+//Tailer follows one or more files
+type Tailer struct {
+	state   string
+	offsets map[string]offset
+	lines   chan Line
+	errors  chan error
+	stop    chan struct{}
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+}
+
+//Follow follows the given files from where it left off according to the state
+//file, or from their start. Files that do not exist yet are followed once they
+//are created. Truncation and rotation, by moving the file and creating a new one
+//or by copying and truncating it, are detected. With an empty state, where the
+//files were left off is not persisted
+func Follow(state string, paths ...string) (*Tailer, error) {
+	t := &Tailer{
+		state:   state,
+		offsets: map[string]offset{},
+		lines:   make(chan Line),
+		errors:  make(chan error),
+		stop:    make(chan struct{}),
+	}
+
+	if state != "" {
+		data, err := ioutil.ReadFile(state)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("Failed to read state '%s': %s", state, err)
+		} else if err == nil {
+			err = json.Unmarshal(data, &t.offsets)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to decode state '%s': %s", state, err)
+			}
+		}
+	}
+
+	fs := []*follower{}
+	for _, path := range paths {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to determine absolute path for '%s': %s", path, err)
+		}
+
+		m, err := monitor.NewFile(abs)
+		if err == nil {
+			_, err = m.Start()
+		}
+
+		if err != nil {
+			for _, f := range fs {
+				f.m.Stop()
+			}
+
+			return nil, fmt.Errorf("Failed to follow '%s': %s", path, err)
+		}
+
+		fs = append(fs, &follower{m: m, path: abs})
+	}
+
+	for _, f := range fs {
+		t.wg.Add(1)
+		go t.follow(f)
+	}
+
+	return t, nil
+}
+
+//Lines delivers every complete line in the order it was written
+func (t *Tailer) Lines() <-chan Line {
+	return t.lines
+}
+
+//Errors delivers every failure to read a file
+func (t *Tailer) Errors() <-chan error {
+	return t.errors
+}
+
+//Stop ends following all files, where each one was left
+//off is persisted if there is a state file
+func (t *Tailer) Stop() error {
+	select {
+	case <-t.stop:
+		return monitor.ErrAlreadyStopped
+	default:
+	}
+
+	close(t.stop)
+	t.wg.Wait()
+	return nil
+}
+
+func (t *Tailer) follow(f *follower) {
+	defer t.wg.Done()
+	defer f.m.Stop()
+	defer func() {
+		if f.file != nil {
+			f.file.Close()
+		}
+	}()
+
+	for {
+		err := t.read(f)
+		if err == errStopped {
+			return
+		} else if err != nil {
+			t.fail(fmt.Errorf("Failed to read '%s': %s", f.path, err))
+		}
+
+		select {
+		case ev := <-f.m.Events():
+			if _, ok := ev.(monitor.RootEvent); ok {
+				t.fail(fmt.Errorf("Stopped following '%s', its directory is gone", f.path))
+				return
+			}
+		case err := <-f.m.Errors():
+			t.fail(err)
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+//reads what was appended since the last time. When the path resolves to
+//another file or to none at all the old file was rotated, it is read until
+//its end before the new one is opened, once there is one
+func (t *Tailer) read(f *follower) error {
+	fi, err := os.Stat(f.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if f.file != nil && (fi == nil || !os.SameFile(f.fi, fi)) {
+		err = t.drain(f, true)
+		if err != nil || fi == nil {
+			return err
+		}
+
+		f.file.Close()
+		f.file = nil
+		f.offset = 0
+		f.start = nil
+	}
+
+	if fi == nil {
+		return nil
+	}
+
+	if f.file == nil {
+		f.file, err = os.Open(f.path)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		f.fi, err = f.file.Stat()
+		if err != nil {
+			return err
+		}
+
+		if !f.resumed {
+			f.resumed = true
+			f.offset = t.resume(f)
+		}
+	}
+
+	//copied and truncated, or simply truncated. When lines were handed over
+	//slowly it might have grown past the offset again, it then no longer
+	//starts with what was read
+	cur, err := f.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	truncated := cur.Size() < f.offset+int64(len(f.partial))
+	if !truncated && f.offset > 0 {
+		head, err := headOf(f.file, f.offset)
+		if err != nil {
+			return err
+		}
+
+		truncated = head != f.head()
+	}
+
+	if truncated {
+		f.offset = 0
+		f.start = nil
+		f.partial = nil
+	}
+
+	return t.drain(f, false)
+}
+
+//hands over the complete lines up to the end of the file, at the
+//end of a rotated file there won't be a line ending anymore
+func (t *Tailer) drain(f *follower, last bool) error {
+	buf := make([]byte, 32*1024)
+	for {
+		pos := f.offset + int64(len(f.partial))
+		n, err := f.file.ReadAt(buf, pos)
+		if pos == int64(len(f.start)) && pos < headSize {
+			take := int64(n)
+			if take > headSize-pos {
+				take = headSize - pos
+			}
+
+			f.start = append(f.start, buf[:take]...)
+		}
+
+		f.partial = append(f.partial, buf[:n]...)
+		for {
+			i := bytes.IndexByte(f.partial, '\n')
+			if i < 0 {
+				break
+			}
+
+			if !t.deliver(f, f.partial[:i], int64(i+1)) {
+				t.save(f)
+				return errStopped
+			}
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if last && len(f.partial) > 0 && !t.deliver(f, f.partial, int64(len(f.partial))) {
+		t.save(f)
+		return errStopped
+	}
+
+	return t.save(f)
+}
+
+//hands over a line and moves past it, returns false when stopped
+func (t *Tailer) deliver(f *follower, text []byte, n int64) bool {
+	l := Line{
+		Path:   f.path,
+		Text:   string(bytes.TrimSuffix(text, []byte("\r"))),
+		Offset: f.offset + n,
+	}
+
+	select {
+	case t.lines <- l:
+	case <-t.stop:
+		return false
+	}
+
+	f.offset += n
+	f.partial = f.partial[n:]
+	return true
+}
+
+//returns where a file was left off, as long as it is still the same
+//file: one that is at least as large and starts with the same bytes
+func (t *Tailer) resume(f *follower) int64 {
+	t.mu.Lock()
+	o, ok := t.offsets[f.path]
+	t.mu.Unlock()
+	if !ok || f.fi.Size() < o.Offset {
+		return 0
+	}
+
+	start, err := startOf(f.file, o.Offset)
+	if err != nil || hashOf(start) != o.Head {
+		return 0
+	}
+
+	f.start = start
+	return o.Offset
+}
+
+//hashes what the file started with as it was read, up to the offset
+func (f *follower) head() string {
+	n := f.offset
+	if n > int64(len(f.start)) {
+		n = int64(len(f.start))
+	}
+
+	return hashOf(f.start[:n])
+}
+
+//persists where the file was left off, the state
+//file is replaced such that it is never partial
+func (t *Tailer) save(f *follower) error {
+	if t.state == "" {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.offsets[f.path] = offset{f.offset, f.head()}
+	data, err := json.Marshal(t.offsets)
+	if err != nil {
+		return fmt.Errorf("Failed to encode state: %s", err)
+	}
+
+	tmp := t.state + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to write state '%s': %s", tmp, err)
+	}
+
+	err = os.Rename(tmp, t.state)
+	if err != nil {
+		return fmt.Errorf("Failed to replace state '%s': %s", t.state, err)
+	}
+
+	return nil
+}
+
+func (t *Tailer) fail(err error) {
+	select {
+	case t.errors <- err:
+	case <-t.stop:
+	}
+}
+
+//hashes the start of a file, up to the offset
+func headOf(file *os.File, offset int64) (string, error) {
+	start, err := startOf(file, offset)
+	if err != nil {
+		return "", err
+	}
+
+	return hashOf(start), nil
+}
+
+//reads the start of a file, up to the offset and the size of a head
+func startOf(file *os.File, offset int64) ([]byte, error) {
+	n := offset
+	if n > headSize {
+		n = headSize
+	}
+
+	buf := make([]byte, n)
+	m, err := file.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return buf[:m], nil
+}
+
+func hashOf(data []byte) string {
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
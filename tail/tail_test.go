@@ -0,0 +1,195 @@
+package tail
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var Timeout = time.Millisecond * 200
+
+func setupTestDir(t *testing.T) string {
+	tdir, err := ioutil.TempDir("", ".timeglass_tail")
+	if err != nil {
+		t.Fatalf("Failed to create test directory: %s", err)
+	}
+
+	return tdir
+}
+
+func setupTestTailer(t *testing.T, state string, paths ...string) *Tailer {
+	tl, err := Follow(state, paths...)
+	if err != nil {
+		t.Fatalf("Failed to follow %v: %s", paths, err)
+	}
+
+	return tl
+}
+
+func doAppend(t *testing.T, path, data string) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open '%s': %s", path, err)
+	}
+
+	defer f.Close()
+	_, err = f.WriteString(data)
+	if err != nil {
+		t.Fatalf("Failed to append to '%s': %s", path, err)
+	}
+}
+
+func doMove(t *testing.T, from, to string) {
+	err := os.Rename(from, to)
+	if err != nil {
+		t.Fatalf("Failed to rename from '%s' to '%s': '%s'", from, to, err)
+	}
+}
+
+func assertLines(t *testing.T, tl *Tailer, texts ...string) {
+	for _, text := range texts {
+		select {
+		case l := <-tl.Lines():
+			if l.Text != text {
+				t.Fatalf("Expected line '%s', got: '%s'", text, l.Text)
+			}
+		case err := <-tl.Errors():
+			t.Fatalf("Expected line '%s', got error: %s", text, err)
+		case <-time.After(Timeout):
+			t.Fatalf("Timed out waiting for line '%s'", text)
+		}
+	}
+}
+
+func assertNoLines(t *testing.T, tl *Tailer) {
+	select {
+	case l := <-tl.Lines():
+		t.Fatalf("Expected no more lines, got: '%s'", l.Text)
+	case err := <-tl.Errors():
+		t.Fatalf("Expected no more lines, got error: %s", err)
+	case <-time.After(Timeout):
+	}
+}
+
+func assertStop(t *testing.T, tl *Tailer) {
+	err := tl.Stop()
+	if err != nil {
+		t.Fatalf("Failed to stop: %s", err)
+	}
+}
+
+func TestFollowAppend(t *testing.T) {
+	path := filepath.Join(setupTestDir(t), "app.log")
+	doAppend(t, path, "line 1\nline 2\n")
+
+	tl := setupTestTailer(t, "", path)
+	assertLines(t, tl, "line 1", "line 2")
+
+	//only complete lines are handed over
+	doAppend(t, path, "line 3\nline")
+	assertLines(t, tl, "line 3")
+	assertNoLines(t, tl)
+
+	doAppend(t, path, " 4\r\n")
+	assertLines(t, tl, "line 4")
+	assertStop(t, tl)
+}
+
+func TestFollowMultiple(t *testing.T) {
+	tdir := setupTestDir(t)
+	tl := setupTestTailer(t, "", filepath.Join(tdir, "a.log"), filepath.Join(tdir, "b.log"))
+
+	doAppend(t, filepath.Join(tdir, "a.log"), "line a\n")
+	assertLines(t, tl, "line a")
+	doAppend(t, filepath.Join(tdir, "b.log"), "line b\n")
+	assertLines(t, tl, "line b")
+	assertStop(t, tl)
+}
+
+func TestFollowMissing(t *testing.T) {
+	path := filepath.Join(setupTestDir(t), "app.log")
+	tl := setupTestTailer(t, "", path)
+	assertNoLines(t, tl)
+
+	doAppend(t, path, "line 1\n")
+	assertLines(t, tl, "line 1")
+	assertStop(t, tl)
+}
+
+func TestFollowTruncated(t *testing.T) {
+	path := filepath.Join(setupTestDir(t), "app.log")
+	doAppend(t, path, "line 1\nline 2\n")
+
+	tl := setupTestTailer(t, "", path)
+	assertLines(t, tl, "line 1", "line 2")
+
+	//copytruncate
+	err := os.Truncate(path, 0)
+	if err != nil {
+		t.Fatalf("Failed to truncate '%s': %s", path, err)
+	}
+
+	doAppend(t, path, "line 3\n")
+	assertLines(t, tl, "line 3")
+	assertStop(t, tl)
+}
+
+func TestFollowTruncatedWhileDelivering(t *testing.T) {
+	path := filepath.Join(setupTestDir(t), "app.log")
+	doAppend(t, path, "line 1\nline 2\n")
+
+	tl := setupTestTailer(t, "", path)
+	assertLines(t, tl, "line 1")
+
+	//copytruncate while line 2 is still being handed over, the
+	//file grows past where it was left off before it is read again
+	err := os.Truncate(path, 0)
+	if err != nil {
+		t.Fatalf("Failed to truncate '%s': %s", path, err)
+	}
+
+	doAppend(t, path, "line 3 is longer than the first two\n")
+	assertLines(t, tl, "line 2", "line 3 is longer than the first two")
+	assertStop(t, tl)
+}
+
+func TestFollowRotated(t *testing.T) {
+	path := filepath.Join(setupTestDir(t), "app.log")
+	doAppend(t, path, "line 1\n")
+
+	tl := setupTestTailer(t, "", path)
+	assertLines(t, tl, "line 1")
+
+	//the rest of the old file comes first
+	doAppend(t, path, "line 2\n")
+	doMove(t, path, path+".1")
+	doAppend(t, path, "line 3\n")
+	assertLines(t, tl, "line 2", "line 3")
+	assertStop(t, tl)
+}
+
+func TestFollowResumed(t *testing.T) {
+	tdir := setupTestDir(t)
+	path := filepath.Join(tdir, "app.log")
+	state := filepath.Join(tdir, "state.json")
+	doAppend(t, path, "line 1\nline 2\n")
+
+	tl := setupTestTailer(t, state, path)
+	assertLines(t, tl, "line 1", "line 2")
+	assertStop(t, tl)
+
+	doAppend(t, path, "line 3\n")
+	tl = setupTestTailer(t, state, path)
+	assertLines(t, tl, "line 3")
+	assertNoLines(t, tl)
+	assertStop(t, tl)
+
+	//rotated in the meantime, the new file is read from its start
+	doMove(t, path, path+".1")
+	doAppend(t, path, "line 4\nline 5\nline 6\n")
+	tl = setupTestTailer(t, state, path)
+	assertLines(t, tl, "line 4", "line 5", "line 6")
+	assertStop(t, tl)
+}